@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// validToken reports whether token matches Options.AuthToken. It takes the
+// same time whatever the mismatch, so the token can't be guessed byte by
+// byte. With no token configured every caller is allowed, as before.
+func (ds *Datastore) validToken(token string) bool {
+	if ds.opts.AuthToken == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(ds.opts.AuthToken)) == 1
+}
+
+// requireAuth wraps next so it only runs for requests carrying
+// "Authorization: Bearer <token>" with the configured token. Others get 401.
+// With no token configured next is returned unchanged.
+func (ds *Datastore) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	if ds.opts.AuthToken == "" {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		token, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok || !ds.validToken(token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, errorResponse(nil, http.StatusUnauthorized))
+			return
+		}
+
+		next(w, r)
+	}
+}
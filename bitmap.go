@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math/bits"
+	"net/http"
+	"strconv"
+)
+
+// maxBitOffset is the highest offset SETBIT accepts, which caps a bitmap at
+// 64MiB however far out a single command reaches. Options.MaxValueBytes, when
+// lower, caps it further.
+const maxBitOffset = 64<<20*8 - 1
+
+const bitOffsetMessage = "bit offset is not an integer or out of range"
+
+// parseBitOffset parses a SETBIT or GETBIT offset
+func parseBitOffset(s string) (int, bool) {
+	offset, err := strconv.Atoi(s)
+	if err != nil || offset < 0 || offset > maxBitOffset {
+		return 0, false
+	}
+	return offset, true
+}
+
+// bitAt returns the bit at offset in b, counting from the most significant
+// bit of the first byte, and 0 past the end
+func bitAt(b []byte, offset int) int {
+	if offset/8 >= len(b) {
+		return 0
+	}
+	return int(b[offset/8]>>(7-uint(offset%8))) & 1
+}
+
+// SetBit sets the bit at offset in the bitmap at key to bit, creating the key
+// and growing the bitmap with zero bytes as needed, and returns the bit's old
+// value. The bitmap keeps any TTL it already has.
+func (ds *Datastore) SetBit(key string, offset, bit int) (int, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if !ok {
+		data = &Data{isBitmap: true}
+	} else if !data.isBitmap {
+		return 0, http.StatusConflict
+	}
+
+	length := offset/8 + 1
+	if length > len(data.bits) {
+		if ds.valueTooLarge(length) {
+			return 0, http.StatusRequestEntityTooLarge
+		}
+		if !ds.makeRoom(key, func() int { return data.approxSize(key) + length - len(data.bits) }) {
+			return 0, http.StatusInsufficientStorage
+		}
+		data.bits = append(data.bits, make([]byte, length-len(data.bits))...)
+	}
+	if !ok {
+		ds.put(key, data)
+	}
+
+	old := bitAt(data.bits, offset)
+	mask := byte(1) << (7 - uint(offset%8))
+	if bit == 1 {
+		data.bits[offset/8] |= mask
+	} else {
+		data.bits[offset/8] &^= mask
+	}
+
+	return old, http.StatusOK
+}
+
+// GetBit returns the bit at offset in the bitmap at key. A missing key, like
+// an offset past the end, gives 0.
+func (ds *Datastore) GetBit(key string, offset int) (int, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return 0, http.StatusOK
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return 0, http.StatusOK
+	}
+	if !data.isBitmap {
+		return 0, http.StatusConflict
+	}
+	data.touch()
+
+	return bitAt(data.bits, offset), http.StatusOK
+}
+
+// BitCount returns the number of set bits in bytes start through stop of the
+// bitmap at key, with the same index rules as QRange. A missing key gives 0.
+func (ds *Datastore) BitCount(key string, start, stop int) (int, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return 0, http.StatusOK
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return 0, http.StatusOK
+	}
+	if !data.isBitmap {
+		return 0, http.StatusConflict
+	}
+	data.touch()
+
+	start, stop, ok = clampRange(start, stop, len(data.bits))
+	if !ok {
+		return 0, http.StatusOK
+	}
+
+	count := 0
+	for _, b := range data.bits[start : stop+1] {
+		count += bits.OnesCount8(b)
+	}
+	return count, http.StatusOK
+}
@@ -0,0 +1,169 @@
+package main
+
+import "time"
+
+// Eviction policies for Options.EvictionPolicy
+const (
+	EvictionLRU        = "lru"        // Evict the least recently used key
+	EvictionLFU        = "lfu"        // Evict the least frequently used key
+	EvictionRandom     = "random"     // Evict an arbitrary key
+	EvictionNoEviction = "noeviction" // Refuse writes once a limit is reached
+
+	// EvictionVolatileTTL evicts the key closest to expiring. Keys without
+	// an expiry are never evicted, so writes fail once none are left.
+	EvictionVolatileTTL = "volatile-ttl"
+)
+
+// LFUDecayPeriod is how long a key must go unused for its access counter to
+// halve, so keys that were popular long ago do not stay pinned forever
+const LFUDecayPeriod = time.Minute
+
+// EvictionSamples is the number of keys looked at to pick each one to evict
+const EvictionSamples = 16
+
+func validEvictionPolicy(policy string) bool {
+	switch policy {
+	case "", EvictionLRU, EvictionLFU, EvictionRandom, EvictionNoEviction, EvictionVolatileTTL:
+		return true
+	}
+	return false
+}
+
+// decayFrequency halves freq once for every LFUDecayPeriod in idleNanos
+func decayFrequency(freq, idleNanos int64) int64 {
+	periods := idleNanos / int64(LFUDecayPeriod)
+	if periods >= 63 {
+		return 0
+	}
+	return freq >> uint(periods)
+}
+
+// makeRoom evicts entries according to the eviction policy until storing an
+// entry under key stays within the MaxKeys and MaxBytes limits. key itself is
+// never evicted. It returns false if the limits cannot be met. size gives the
+// approximate size in bytes the entry will have, and is only called when
+// MaxBytes is set, since measuring a collection takes time in proportion to
+// its length. The caller must hold the write lock.
+func (ds *Datastore) makeRoom(key string, size func() int) bool {
+	if ds.opts.MaxKeys <= 0 && ds.opts.MaxBytes <= 0 {
+		return true
+	}
+	n := 0
+	if ds.opts.MaxBytes > 0 {
+		n = size()
+	}
+	return ds.makeRoomFor(map[string]int{key: n})
+}
+
+// makeRoomFor is makeRoom for several entries written together, given as
+// their approximate sizes by key, so a batch is checked as a whole before
+// any of it is written. None of the batch's keys are evicted.
+func (ds *Datastore) makeRoomFor(sizes map[string]int) bool {
+	if ds.opts.MaxKeys <= 0 && ds.opts.MaxBytes <= 0 {
+		return true
+	}
+	ds.updateUsedBytes()
+
+	count, used, total := len(ds.data), ds.usedBytes, 0
+	for key, size := range sizes {
+		if data, exists := ds.data[key]; exists {
+			used -= data.counted
+			ds.changed(key, data) // The caller is about to write it
+		} else {
+			count++
+		}
+		used += size
+		total += size
+	}
+	if (ds.opts.MaxKeys > 0 && len(sizes) > ds.opts.MaxKeys) || (ds.opts.MaxBytes > 0 && total > ds.opts.MaxBytes) {
+		return false // Evicting everything else would not help
+	}
+
+	for {
+		keysOK := ds.opts.MaxKeys <= 0 || count <= ds.opts.MaxKeys
+		bytesOK := ds.opts.MaxBytes <= 0 || used <= ds.opts.MaxBytes
+		if keysOK && bytesOK {
+			return true
+		}
+
+		victim, ok := ds.evictionCandidate(sizes)
+		if !ok {
+			return false
+		}
+		used -= ds.data[victim].counted
+		count--
+		ds.remove(victim)
+		ds.evictions++
+	}
+}
+
+// changed notes that the entry at key may have changed size in place, so
+// usedBytes is brought up to date before it is next relied on. The caller
+// must hold the write lock.
+func (ds *Datastore) changed(key string, data *Data) {
+	if ds.opts.MaxBytes > 0 {
+		ds.resized[key] = data
+	}
+}
+
+// updateUsedBytes measures the entries noted by changed again, so usedBytes
+// is kept up to date in proportion to what was written rather than to
+// everything stored. The caller must hold the write lock.
+func (ds *Datastore) updateUsedBytes() {
+	for key, data := range ds.resized {
+		if ds.data[key] == data { // Removed or replaced entries were already uncounted
+			size := data.approxSize(key)
+			ds.usedBytes += size - data.counted
+			data.counted = size
+		}
+		delete(ds.resized, key)
+	}
+}
+
+// evictionCandidate picks a key not in exclude to evict next. Like Redis it
+// only looks at a random sample of EvictionSamples keys, taking map
+// iteration order as the randomness, so evicting takes the same time however
+// many keys there are. Should none of the sample be evictable, as when
+// volatile-ttl meets keys without an expiry, it looks further until one is
+// found. Entries that have already expired are always preferred. With the
+// noeviction policy only expired entries in the sample are returned, and
+// the rest are left to the expiry reaper.
+func (ds *Datastore) evictionCandidate(exclude map[string]int) (string, bool) {
+	now := time.Now().UnixNano()
+	victim, found := "", false
+	var best int64
+	examined := 0
+	for key, data := range ds.data {
+		if examined >= EvictionSamples && (found || ds.opts.EvictionPolicy == EvictionNoEviction) {
+			break
+		}
+		if _, ok := exclude[key]; ok {
+			continue
+		}
+		examined++
+		if data.isExpired() {
+			return key, true
+		}
+
+		var score int64 // Lower scores are evicted first
+		switch ds.opts.EvictionPolicy {
+		case EvictionNoEviction:
+			continue
+		case EvictionRandom:
+			score = 0 // Map iteration order is already randomized
+		case EvictionVolatileTTL:
+			if data.expiry.IsZero() {
+				continue
+			}
+			score = data.expiry.UnixNano()
+		case EvictionLFU:
+			score = decayFrequency(data.frequency, now-data.lastAccess)
+		default:
+			score = data.lastAccess
+		}
+		if !found || score < best {
+			victim, best, found = key, score, true
+		}
+	}
+	return victim, found
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"testing"
+)
+
+func TestMSetIsAllOrNothingUnderLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     Options
+		setup    []string
+		mset     string
+		status   int
+		want     string // EXISTS over every key involved
+		existing string
+	}{
+		{
+			name:   "noeviction refuses the whole batch",
+			opts:   Options{MaxKeys: 2, EvictionPolicy: EvictionNoEviction},
+			mset:   "MSET a 1 b 2 c 3",
+			status: http.StatusInsufficientStorage,
+			want:   `{"count":0}`,
+		},
+		{
+			name:   "a batch larger than the limit evicts nothing of itself",
+			opts:   Options{MaxKeys: 1},
+			mset:   "MSET a 1 b 2",
+			status: http.StatusInsufficientStorage,
+			want:   `{"count":0}`,
+		},
+		{
+			name:     "lru makes room for the whole batch before writing",
+			opts:     Options{MaxKeys: 2},
+			setup:    []string{"SET x 1", "SET y 1"},
+			mset:     "MSET a 1 b 2",
+			status:   http.StatusOK,
+			want:     `{"count":2}`,
+			existing: `{"count":0}`,
+		},
+		{
+			name:   "byte limit counts the batch as a whole",
+			opts:   Options{MaxBytes: 2 * (&Data{value: "1"}).approxSize("a")},
+			mset:   "MSET a 1 b 1 c 1",
+			status: http.StatusInsufficientStorage,
+			want:   `{"count":0}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := NewDatastore(tt.opts)
+			for _, command := range tt.setup {
+				if _, status := do(t, ds, command); status != http.StatusOK {
+					t.Fatalf("%s = %d", command, status)
+				}
+			}
+
+			if _, status := do(t, ds, tt.mset); status != tt.status {
+				t.Fatalf("%s status = %d, want %d", tt.mset, status, tt.status)
+			}
+			if got, _ := do(t, ds, "EXISTS a b c"); got != tt.want {
+				t.Errorf("EXISTS a b c = %s, want %s", got, tt.want)
+			}
+			if tt.existing != "" {
+				if got, _ := do(t, ds, "EXISTS x y"); got != tt.existing {
+					t.Errorf("EXISTS x y = %s, want %s", got, tt.existing)
+				}
+			}
+		})
+	}
+}
+
+// TestUsedBytesTracksEntries checks that the running usedBytes total agrees
+// with measuring every entry from scratch after a mix of writes of every type
+func TestUsedBytesTracksEntries(t *testing.T) {
+	ds := NewDatastore(Options{MaxBytes: 1 << 30})
+	commands := []string{
+		"SET s hello", "APPEND s world", "SET n 10", "INCRBY n 5", "GETSET s x",
+		"QPUSH q a b c d", "QPOP q", "QPUSHFRONT q z", "QTRIM q 0 1", "QRESERVE q 30",
+		"HSET h f1 v1 f2 v2", "HDEL h f1", "HINCRBY h n 3",
+		"SADD set a b c", "SREM set b", "SUNIONSTORE u set set",
+		"ZADD z 1 a 2 b", "ZPOPMIN z",
+		"SETBIT b 100 1", "PFADD p x y", "XADD x e1", "XADD x MAXLEN 1 e2",
+		"RENAME s s2", "COPY q q2", "DEL n", "MSET m1 a m2 b", "QMOVE q2 q3",
+		"JSET j a.b 1", "JSET j a.c hello",
+	}
+	for _, command := range commands {
+		if _, status := do(t, ds, command); status != http.StatusOK {
+			t.Fatalf("%s = %d", command, status)
+		}
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.updateUsedBytes()
+	want := 0
+	for key, data := range ds.data {
+		want += data.approxSize(key)
+	}
+	if ds.usedBytes != want {
+		t.Errorf("usedBytes = %d, measuring every entry gives %d", ds.usedBytes, want)
+	}
+}
+
+func TestMaxBytesEvictsLeastRecentlyUsed(t *testing.T) {
+	size := (&Data{value: "v"}).approxSize("k0")
+	ds := NewDatastore(Options{MaxBytes: 3 * size})
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		ds.HandleCommand(ctx, fmt.Sprintf("SET k%d v", i))
+	}
+	ds.HandleCommand(ctx, "GET k0") // k1 is now the least recently used
+	ds.HandleCommand(ctx, "SET k3 v")
+
+	runSteps(t, ds, []step{
+		{"EXISTS k0 k2 k3", `{"count":3}`, http.StatusOK},
+		{"EXISTS k1", `{"count":0}`, http.StatusOK},
+	})
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	tests := []struct {
+		policy  string
+		status  int    // Of the write that needs room
+		evicted string // Which of hot, cold and ttl goes, if any
+	}{
+		{EvictionLFU, http.StatusOK, "cold"},
+		{EvictionLRU, http.StatusOK, "hot"}, // hot was read often, but not lately
+		{EvictionVolatileTTL, http.StatusOK, "ttl"},
+		{EvictionNoEviction, http.StatusInsufficientStorage, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			ds := NewDatastore(Options{MaxKeys: 3, EvictionPolicy: tt.policy})
+			runSteps(t, ds, []step{{"SET hot v", `"Enter data sucessfull"`, http.StatusOK}})
+			for i := 0; i < 20; i++ {
+				do(t, ds, "GET hot")
+			}
+			runSteps(t, ds, []step{
+				{"SET cold v", `"Enter data sucessfull"`, http.StatusOK},
+				{"SET ttl v EX100", `"Enter data sucessfull"`, http.StatusOK},
+			})
+			for i := 0; i < 5; i++ {
+				do(t, ds, "GET ttl") // So cold alone is the least frequently used
+			}
+
+			if _, status := do(t, ds, "SET new v"); status != tt.status {
+				t.Fatalf("SET new v = %d, want %d", status, tt.status)
+			}
+			for _, key := range []string{"hot", "cold", "ttl"} {
+				want := `{"count":1}`
+				if key == tt.evicted {
+					want = `{"count":0}`
+				}
+				runSteps(t, ds, []step{{"EXISTS " + key, want, http.StatusOK}})
+			}
+		})
+	}
+}
+
+func TestRandomEvictionMakesRoom(t *testing.T) {
+	ds := NewDatastore(Options{MaxKeys: 3, EvictionPolicy: EvictionRandom})
+	runSteps(t, ds, []step{
+		{"MSET a 1 b 2 c 3", `"Enter data sucessfull"`, http.StatusOK},
+		{"SET d 4", `"Enter data sucessfull"`, http.StatusOK},
+		{"EXISTS a b c", `{"count":2}`, http.StatusOK},
+		{"EXISTS d", `{"count":1}`, http.StatusOK},
+	})
+}
+
+func TestDecayFrequency(t *testing.T) {
+	tests := []struct {
+		freq, idle, want int64
+	}{
+		{100, 0, 100},
+		{100, int64(LFUDecayPeriod) - 1, 100},
+		{100, int64(LFUDecayPeriod), 50},
+		{100, 3 * int64(LFUDecayPeriod), 12},
+		{100, 63 * int64(LFUDecayPeriod), 0},
+		{100, math.MaxInt64, 0},
+	}
+
+	for _, tt := range tests {
+		if got := decayFrequency(tt.freq, tt.idle); got != tt.want {
+			t.Errorf("decayFrequency(%d, %d) = %d, want %d", tt.freq, tt.idle, got, tt.want)
+		}
+	}
+}
+
+func TestValidEvictionPolicy(t *testing.T) {
+	for _, policy := range []string{"", EvictionLRU, EvictionLFU, EvictionRandom, EvictionNoEviction, EvictionVolatileTTL} {
+		if !validEvictionPolicy(policy) {
+			t.Errorf("%q rejected", policy)
+		}
+	}
+	for _, policy := range []string{"LRU", "fifo", "allkeys-lru"} {
+		if validEvictionPolicy(policy) {
+			t.Errorf("%q accepted", policy)
+		}
+	}
+}
+
+func TestMaxKeysBoundary(t *testing.T) {
+	tests := []struct {
+		policy string
+		steps  []step // Run once the datastore holds its limit of a, b and c
+	}{
+		{EvictionNoEviction, []step{
+			{"SET a again", `"Enter data sucessfull"`, http.StatusOK}, // Replacing takes no new room
+			{"QPUSH a x", `"` + wrongTypeMessage + `"`, http.StatusConflict},
+			{"SET d v", `"` + outOfMemoryMessage + `"`, http.StatusInsufficientStorage},
+			{"QPUSH q x", `"` + outOfMemoryMessage + `"`, http.StatusInsufficientStorage},
+			{"DBSIZE", `{"keys":3}`, http.StatusOK},
+			{"DEL c", `{"deleted":1}`, http.StatusOK},
+			{"QPUSH q x", `"Value is pushed successfully"`, http.StatusOK},
+			{"DBSIZE", `{"keys":3}`, http.StatusOK},
+		}},
+		{EvictionVolatileTTL, []step{
+			{"SET a again", `"Enter data sucessfull"`, http.StatusOK},
+			{"DBSIZE", `{"keys":3}`, http.StatusOK},
+			{"SET d v", `"Enter data sucessfull"`, http.StatusOK}, // b expires first, so goes
+			{"EXISTS a c d", `{"count":3}`, http.StatusOK},
+			{"EXISTS b", `{"count":0}`, http.StatusOK},
+			{"QPUSH q x", `"Value is pushed successfully"`, http.StatusOK}, // Then c, the only TTL left
+			{"EXISTS a d q", `{"count":3}`, http.StatusOK},
+			{"EXISTS c", `{"count":0}`, http.StatusOK},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			ds := NewDatastore(Options{MaxKeys: 3, EvictionPolicy: tt.policy})
+			runSteps(t, ds, []step{
+				{"SET a v", `"Enter data sucessfull"`, http.StatusOK},
+				{"SET b v EX100", `"Enter data sucessfull"`, http.StatusOK},
+				{"SET c v EX200", `"Enter data sucessfull"`, http.StatusOK},
+			})
+			runSteps(t, ds, tt.steps)
+		})
+	}
+}
+
+func TestMakeRoomMeasuresOnlyWithAByteLimit(t *testing.T) {
+	for _, opts := range []Options{{}, {MaxKeys: 10}, {MaxBytes: 1 << 20}, {MaxKeys: 10, MaxBytes: 1 << 20}} {
+		ds := NewDatastore(opts)
+		measured := false
+		ds.mu.Lock()
+		ok := ds.makeRoom("k", func() int { measured = true; return 1 })
+		ds.mu.Unlock()
+
+		if !ok {
+			t.Errorf("%+v: makeRoom refused a 1 byte entry", opts)
+		}
+		if want := opts.MaxBytes > 0; measured != want {
+			t.Errorf("%+v: size measured = %v, want %v", opts, measured, want)
+		}
+	}
+}
+
+// TestLRUEvictionSamplesOldKeys checks that evicting from a sample still
+// picks old keys: a sample of EvictionSamples keys holding none from the
+// oldest three quarters is vanishingly unlikely
+func TestLRUEvictionSamplesOldKeys(t *testing.T) {
+	const keys = 1000
+	ds := NewDatastore(Options{MaxKeys: keys})
+	for i := 0; i < keys; i++ {
+		ds.Set(fmt.Sprintf("k%d", i), "v", setOptions{})
+	}
+
+	for i := 0; i < 100; i++ {
+		ds.Set(fmt.Sprintf("new%d", i), "v", setOptions{})
+	}
+	if n := ds.DBSize(); n != keys {
+		t.Fatalf("DBSIZE = %d, want %d", n, keys)
+	}
+	for i := keys * 3 / 4; i < keys; i++ {
+		if ds.Exists(fmt.Sprintf("k%d", i)) != 1 {
+			t.Errorf("k%d, one of the newest quarter, was evicted", i)
+		}
+	}
+}
+
+func TestVolatileTTLEvictionLooksPastTheSample(t *testing.T) {
+	const keys = 1000
+	ds := NewDatastore(Options{MaxKeys: keys + 1, EvictionPolicy: EvictionVolatileTTL})
+	for i := 0; i < keys; i++ {
+		ds.Set(fmt.Sprintf("k%d", i), "v", setOptions{})
+	}
+	runSteps(t, ds, []step{
+		{"SET ttl v EX100", `"Enter data sucessfull"`, http.StatusOK},
+		{"SET new v", `"Enter data sucessfull"`, http.StatusOK},
+		{"EXISTS ttl", `{"count":0}`, http.StatusOK},
+		{"SET another v", `"` + outOfMemoryMessage + `"`, http.StatusInsufficientStorage},
+	})
+}
+
+// BenchmarkEviction measures a SET that has to evict a key from a full
+// keyspace of 100000
+func BenchmarkEviction(b *testing.B) {
+	const keys = 100000
+	ds := NewDatastore(Options{MaxKeys: keys})
+	for i := 0; i < keys; i++ {
+		ds.Set(fmt.Sprintf("k%d", i), "v", setOptions{})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ds.Set(fmt.Sprintf("new%d", i), "v", setOptions{})
+	}
+}
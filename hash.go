@@ -0,0 +1,244 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// HSet sets the given field/value pairs in the hash at key, creating it if
+// missing, and returns how many of the fields are new. The hash keeps any
+// TTL it already has.
+func (ds *Datastore) HSet(key string, pairs ...string) (int, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if !ok {
+		data = &Data{isHash: true, hash: map[string]string{}}
+	} else if !data.isHash {
+		return 0, http.StatusConflict
+	}
+
+	size := func() int {
+		size := data.approxSize(key)
+		for i := 0; i < len(pairs); i += 2 {
+			size += hashFieldOverheadBytes + len(pairs[i]) + len(pairs[i+1])
+		}
+		return size
+	}
+	if !ds.makeRoom(key, size) {
+		return 0, http.StatusInsufficientStorage
+	}
+	if !ok {
+		ds.put(key, data)
+	}
+
+	added := 0
+	for i := 0; i < len(pairs); i += 2 {
+		if _, exists := data.hash[pairs[i]]; !exists {
+			added++
+		}
+		data.hash[pairs[i]] = pairs[i+1]
+	}
+
+	return added, http.StatusOK
+}
+
+// HGet returns the value of field in the hash at key. A missing key or field
+// gives StatusNotFound.
+func (ds *Datastore) HGet(key, field string) (string, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return "Key not exist", http.StatusNotFound
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return "Key not exist", http.StatusNotFound
+	}
+	if !data.isHash {
+		return wrongTypeMessage, http.StatusConflict
+	}
+	value, ok := data.hash[field]
+	if !ok {
+		return "Field not exist", http.StatusNotFound
+	}
+	data.touch()
+
+	return value, http.StatusOK
+}
+
+// HDel removes fields from the hash at key and returns how many existed. The
+// key is deleted along with its last field.
+func (ds *Datastore) HDel(key string, fields ...string) (int, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if !ok {
+		return 0, http.StatusOK
+	}
+	if !data.isHash {
+		return 0, http.StatusConflict
+	}
+
+	deleted := 0
+	for _, field := range fields {
+		if _, exists := data.hash[field]; exists {
+			delete(data.hash, field)
+			deleted++
+		}
+	}
+	if len(data.hash) == 0 {
+		ds.remove(key)
+	}
+
+	return deleted, http.StatusOK
+}
+
+// HGetAll returns a copy of every field and value in the hash at key. A
+// missing key gives an empty hash.
+func (ds *Datastore) HGetAll(key string) (map[string]string, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return map[string]string{}, http.StatusOK
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return map[string]string{}, http.StatusOK
+	}
+	if !data.isHash {
+		return nil, http.StatusConflict
+	}
+	data.touch()
+
+	fields := make(map[string]string, len(data.hash))
+	for field, value := range data.hash {
+		fields[field] = value
+	}
+	return fields, http.StatusOK
+}
+
+// HLen returns the number of fields in the hash at key, 0 if the key is
+// missing
+func (ds *Datastore) HLen(key string) (int, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return 0, http.StatusOK
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return 0, http.StatusOK
+	}
+	if !data.isHash {
+		return 0, http.StatusConflict
+	}
+
+	return len(data.hash), http.StatusOK
+}
+
+// HIncrBy adds delta to the integer stored in field of the hash at key and
+// returns the result. A missing key or field counts as 0. Non-integer values
+// and overflow are rejected as a bad request.
+func (ds *Datastore) HIncrBy(key, field string, delta int64) (int64, int) {
+	var next int64
+	status := ds.updateHashField(key, field, func(current string) (string, bool) {
+		n, err := strconv.ParseInt(current, 10, 64)
+		if err != nil {
+			return "", false
+		}
+		next = n + delta
+		if (delta > 0 && next < n) || (delta < 0 && next > n) {
+			return "", false // Overflow
+		}
+		return strconv.FormatInt(next, 10), true
+	})
+
+	return next, status
+}
+
+// HIncrByFloat is HIncrBy for floating point values. The result is stored
+// and returned as formatted by formatFloat.
+func (ds *Datastore) HIncrByFloat(key, field string, delta float64) (string, int) {
+	var next string
+	status := ds.updateHashField(key, field, func(current string) (string, bool) {
+		n, err := strconv.ParseFloat(current, 64)
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+			return "", false
+		}
+		sum := n + delta
+		if math.IsNaN(sum) || math.IsInf(sum, 0) {
+			return "", false
+		}
+		next = formatFloat(sum)
+		return next, true
+	})
+
+	return next, status
+}
+
+// updateHashField replaces field of the hash at key with the result of
+// update, which gets the current value, "0" when the key or field is
+// missing, and reports whether it could be applied.
+func (ds *Datastore) updateHashField(key, field string, update func(current string) (string, bool)) int {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if !ok {
+		data = &Data{isHash: true, hash: map[string]string{}}
+	} else if !data.isHash {
+		return http.StatusConflict
+	}
+
+	current, exists := data.hash[field]
+	if !exists {
+		current = "0"
+	}
+	next, applied := update(current)
+	if !applied {
+		return http.StatusBadRequest
+	}
+
+	size := func() int {
+		if !exists {
+			return data.approxSize(key) + hashFieldOverheadBytes + len(field) + len(next)
+		}
+		return data.approxSize(key) + len(next) - len(current)
+	}
+	if !ds.makeRoom(key, size) {
+		return http.StatusInsufficientStorage
+	}
+	if !ok {
+		ds.put(key, data)
+	}
+	data.hash[field] = next
+
+	return http.StatusOK
+}
+
+// formatFloat renders v with at most 15 significant digits and never in
+// exponent form. Rounding away the last digits drops the binary noise that
+// repeated additions pick up, so 0.1 plus 0.2 gives "0.3".
+func formatFloat(v float64) string {
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(v, 'g', 15, 64), 64)
+	return strconv.FormatFloat(rounded, 'f', -1, 64)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"net/http"
+)
+
+// hllPrecision is the number of hash bits that pick a register. 2^14
+// registers give a standard error of about 0.8%.
+const (
+	hllPrecision = 14
+	hllRegisters = 1 << hllPrecision
+)
+
+// hyperLogLog is a HyperLogLog sketch. Each register holds the longest run of
+// leading zeros, plus one, seen in the hashes routed to it.
+type hyperLogLog [hllRegisters]uint8
+
+// hllHash hashes element to 64 well mixed bits. FNV-1a alone leaves the high
+// bits, which pick the register, poorly spread for short inputs, so its
+// output goes through the MurmurHash3 finalizer.
+func hllHash(element string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(element))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// add records element and reports whether any register changed
+func (h *hyperLogLog) add(element string) bool {
+	x := hllHash(element)
+	index := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank <= h[index] {
+		return false
+	}
+	h[index] = rank
+	return true
+}
+
+// merge raises each register of h to at least that of other
+func (h *hyperLogLog) merge(other *hyperLogLog) {
+	for i, r := range other {
+		if r > h[i] {
+			h[i] = r
+		}
+	}
+}
+
+// count estimates the number of distinct elements added, using linear
+// counting while enough registers are still empty to make it more accurate
+func (h *hyperLogLog) count() int64 {
+	const m = float64(hllRegisters)
+	sum, zeros := 0.0, 0
+	for _, r := range h {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
+
+// PFAdd adds elements to the sketch at key, creating it if missing, and
+// reports whether the estimate may have changed. The sketch keeps any TTL it
+// already has.
+func (ds *Datastore) PFAdd(key string, elements ...string) (bool, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if !ok {
+		data = &Data{isHLL: true, hll: &hyperLogLog{}}
+		if !ds.makeRoom(key, func() int { return data.approxSize(key) }) {
+			return false, http.StatusInsufficientStorage
+		}
+		ds.put(key, data)
+	} else if !data.isHLL {
+		return false, http.StatusConflict
+	}
+
+	updated := !ok // Creating the key counts as a change, as in Redis
+	for _, element := range elements {
+		if data.hll.add(element) {
+			updated = true
+		}
+	}
+
+	return updated, http.StatusOK
+}
+
+// PFCount estimates the number of distinct elements added to the sketches at
+// keys, merged without changing any of them. Missing keys are empty sketches.
+func (ds *Datastore) PFCount(keys ...string) (int64, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	merged, expired, status := ds.mergeHLLLocked(keys)
+	if status != http.StatusOK {
+		return 0, status
+	}
+	return merged.count(), http.StatusOK
+}
+
+// PFMerge stores the union of the sketches at dst and srcs at dst, creating
+// it if missing. An existing dst keeps its TTL.
+func (ds *Datastore) PFMerge(dst string, srcs ...string) (string, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	merged, expired, status := ds.mergeHLLLocked(append([]string{dst}, srcs...))
+	for _, key := range expired {
+		ds.remove(key)
+	}
+	if status != http.StatusOK {
+		return wrongTypeMessage, status
+	}
+
+	data, ok := ds.lookup(dst)
+	if !ok {
+		data = &Data{isHLL: true, hll: merged}
+		if !ds.makeRoom(dst, func() int { return data.approxSize(dst) }) {
+			return outOfMemoryMessage, http.StatusInsufficientStorage
+		}
+		ds.put(dst, data)
+	} else {
+		data.hll = merged
+	}
+
+	return "Keys are merged successfully", http.StatusOK
+}
+
+// mergeHLLLocked returns a new sketch holding the union of the sketches at
+// keys, along with those of keys that have expired and so count as missing.
+// The caller must hold at least the read lock, and remove the expired keys.
+func (ds *Datastore) mergeHLLLocked(keys []string) (*hyperLogLog, []string, int) {
+	merged := &hyperLogLog{}
+	var expired []string
+	for _, key := range keys {
+		data, ok := ds.data[key]
+		if !ok {
+			continue
+		}
+		if data.isExpired() {
+			expired = append(expired, key)
+			continue
+		}
+		if !data.isHLL {
+			return nil, expired, http.StatusConflict
+		}
+		merged.merge(data.hll)
+	}
+	return merged, expired, http.StatusOK
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// hllStdErr is the standard error of a count estimate, 1.04/sqrt(registers)
+var hllStdErr = 1.04 / math.Sqrt(hllRegisters)
+
+// hllError returns the relative error of estimate against n
+func hllError(estimate int64, n int) float64 {
+	return (float64(estimate) - float64(n)) / float64(n)
+}
+
+// TestHyperLogLogAccuracy adds n distinct elements and checks each estimate
+// is within three standard errors of n. The elements come from a fixed seed,
+// and as sequential IP addresses, the counting this is meant for. Linear
+// counting covers the smaller cardinalities.
+func TestHyperLogLogAccuracy(t *testing.T) {
+	elements := []struct {
+		name    string
+		element func(rng *rand.Rand, i int) string
+	}{
+		{"random", func(rng *rand.Rand, i int) string { return strconv.FormatUint(rng.Uint64(), 36) }},
+		{"ip", func(rng *rand.Rand, i int) string {
+			return fmt.Sprintf("10.%d.%d.%d", i>>16&255, i>>8&255, i&255)
+		}},
+	}
+
+	for _, e := range elements {
+		for _, n := range []int{100, 1000, 10000, 100000, 1000000} {
+			t.Run(fmt.Sprintf("%s %d", e.name, n), func(t *testing.T) {
+				rng := rand.New(rand.NewSource(1))
+				var h hyperLogLog
+				for i := 0; i < n; i++ {
+					h.add(e.element(rng, i))
+				}
+
+				got := h.count()
+				if err := hllError(got, n); math.Abs(err) > 3*hllStdErr {
+					t.Errorf("estimate %d is off by %+.2f%%, more than 3 standard errors (%.2f%%)", got, 100*err, 300*hllStdErr)
+				}
+			})
+		}
+	}
+}
+
+// TestHyperLogLogIsUnbiased averages the error over many seeds, which should
+// cancel out to well within a standard error if the estimator is unbiased
+func TestHyperLogLogIsUnbiased(t *testing.T) {
+	const n, seeds = 10000, 20
+
+	total := 0.0
+	for seed := int64(1); seed <= seeds; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		var h hyperLogLog
+		for i := 0; i < n; i++ {
+			h.add(strconv.FormatUint(rng.Uint64(), 36))
+		}
+		total += hllError(h.count(), n)
+	}
+
+	// The mean of the errors has a standard error of hllStdErr/sqrt(seeds)
+	if mean := total / seeds; math.Abs(mean) > 3*hllStdErr/math.Sqrt(seeds) {
+		t.Errorf("mean error over %d seeds = %+.2f%%", seeds, 100*mean)
+	}
+}
+
+func TestPFCountMergesWithoutChangingSketches(t *testing.T) {
+	ds := NewDatastore(Options{})
+	var a, b []string
+	for i := 0; i < 60000; i++ {
+		a = append(a, strconv.Itoa(i))
+		b = append(b, strconv.Itoa(i+40000)) // Overlapping a by 20000
+	}
+	ds.PFAdd("a", a...)
+	ds.PFAdd("b", b...)
+
+	before, _ := ds.PFCount("a")
+	union, status := ds.PFCount("a", "b", "missing")
+	if status != http.StatusOK {
+		t.Fatalf("PFCOUNT a b missing = %d", status)
+	}
+	if err := hllError(union, 100000); math.Abs(err) > 3*hllStdErr {
+		t.Errorf("PFCOUNT a b = %d, off by %+.2f%% from 100000", union, 100*err)
+	}
+	if after, _ := ds.PFCount("a"); after != before {
+		t.Errorf("PFCOUNT a went from %d to %d after counting it with b", before, after)
+	}
+
+	runSteps(t, ds, []step{{"PFMERGE u a b", `"Keys are merged successfully"`, http.StatusOK}})
+	if merged, _ := ds.PFCount("u"); merged != union {
+		t.Errorf("PFCOUNT u = %d after PFMERGE, PFCOUNT a b = %d", merged, union)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// errJSONPathMissing is returned by jsonPathGet when a path segment names a
+// field the document does not have
+var errJSONPathMissing = errors.New("path does not exist")
+
+// parseJSONPath splits a dotted JSET or JGET path into its segments. "."
+// is the whole document and gives no segments.
+func parseJSONPath(path string) ([]string, error) {
+	if path == "." {
+		return nil, nil
+	}
+	segments := strings.Split(path, ".")
+	for _, segment := range segments {
+		if segment == "" {
+			return nil, fmt.Errorf("invalid path %q", path)
+		}
+	}
+	return segments, nil
+}
+
+// decodeJSON parses a stored document. Numbers are kept as written rather
+// than going through float64, so large integers survive a JSET elsewhere in
+// the document.
+func decodeJSON(s string) (interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, errors.New("value is not valid JSON")
+	}
+	if dec.More() {
+		return nil, errors.New("value is not valid JSON")
+	}
+	return doc, nil
+}
+
+// jsonPathGet returns the part of doc at segments
+func jsonPathGet(doc interface{}, segments []string) (interface{}, error) {
+	for i, segment := range segments {
+		object, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s is not an object", strings.Join(segments[:i], "."))
+		}
+		if doc, ok = object[segment]; !ok {
+			return nil, errJSONPathMissing
+		}
+	}
+	return doc, nil
+}
+
+// jsonPathSet returns doc with the part at segments replaced by value,
+// creating any missing objects along the way
+func jsonPathSet(doc interface{}, segments []string, value interface{}) (interface{}, error) {
+	if len(segments) == 0 {
+		return value, nil
+	}
+	object, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("path goes through a value that is not an object")
+	}
+	child, ok := object[segments[0]]
+	if !ok {
+		child = map[string]interface{}{}
+	}
+	child, err := jsonPathSet(child, segments[1:], value)
+	if err != nil {
+		return nil, err
+	}
+	object[segments[0]] = child
+	return doc, nil
+}
+
+// JSet sets the part at path of the JSON document stored at key to value,
+// creating the document, and any objects on the way to path, when missing.
+// value is used as JSON when it parses as JSON and as a JSON string
+// otherwise, so JSET k name Alice and JSET k age 30 both do what they look
+// like. The update happens under the one lock, so concurrent JSETs on
+// different fields of the same document all stick. The document keeps any
+// TTL it already has. A stored value that is not JSON, or a path through a
+// non-object, is a bad request.
+func (ds *Datastore) JSet(key, path, value string) (string, int) {
+	segments, err := parseJSONPath(path)
+	if err != nil {
+		return err.Error(), http.StatusBadRequest
+	}
+	part, err := decodeJSON(value)
+	if err != nil {
+		part = value
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	var doc interface{} = map[string]interface{}{}
+	if ok {
+		if !data.isString() {
+			return wrongTypeMessage, http.StatusConflict
+		}
+		if doc, err = decodeJSON(data.value); err != nil {
+			return err.Error(), http.StatusBadRequest
+		}
+	}
+	if doc, err = jsonPathSet(doc, segments, part); err != nil {
+		return err.Error(), http.StatusBadRequest
+	}
+
+	encoded := encodeJSON(doc)
+	if ds.valueTooLarge(len(encoded)) {
+		return valueTooLargeMessage, http.StatusRequestEntityTooLarge
+	}
+
+	if !ok {
+		data = &Data{}
+	}
+	if !ds.makeRoom(key, func() int { return data.approxSize(key) + len(encoded) - len(data.value) }) {
+		return outOfMemoryMessage, http.StatusInsufficientStorage
+	}
+	if !ok {
+		ds.put(key, data)
+	}
+	data.value = encoded
+
+	return "Enter data sucessfull", http.StatusOK
+}
+
+// JGet returns the part at path of the JSON document stored at key, encoded
+// as JSON. A missing key or field gives StatusNotFound, and a stored value
+// that is not JSON, or a path through a non-object, is a bad request. On
+// failure the string result holds the reason.
+func (ds *Datastore) JGet(key, path string) (json.RawMessage, string, int) {
+	segments, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err.Error(), http.StatusBadRequest
+	}
+
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return nil, "key does not exist", http.StatusNotFound
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return nil, "key does not exist", http.StatusNotFound
+	}
+	if !data.isString() {
+		return nil, wrongTypeMessage, http.StatusConflict
+	}
+	data.touch()
+
+	doc, err := decodeJSON(data.value)
+	if err != nil {
+		return nil, err.Error(), http.StatusBadRequest
+	}
+	part, err := jsonPathGet(doc, segments)
+	if err == errJSONPathMissing {
+		return nil, err.Error(), http.StatusNotFound
+	}
+	if err != nil {
+		return nil, err.Error(), http.StatusBadRequest
+	}
+
+	return json.RawMessage(encodeJSON(part)), "", http.StatusOK
+}
+
+// encodeJSON encodes a document, or part of one, without escaping HTML
+// characters, which a datastore has no reason to
+func encodeJSON(v interface{}) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v) // Decoded JSON always encodes
+	return strings.TrimSuffix(buf.String(), "\n")
+}
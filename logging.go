@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// loggingResponseWriter remembers the status written by a handler and the
+// command verb it ran so logRequests can report them
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	command string
+}
+
+func (lw *loggingResponseWriter) WriteHeader(status int) {
+	lw.status = status
+	lw.ResponseWriter.WriteHeader(status)
+}
+
+// recordCommand attaches the parsed command verb to the request's log line,
+// given the result it ran with. Only the verb is logged, never the
+// arguments, so values stay out of logs, and a verb that is not a command is
+// logged as UNKNOWN, as in the metrics.
+func recordCommand(w http.ResponseWriter, command string, result interface{}) {
+	if _, ok := result.(unknownCommand); ok {
+		command = "UNKNOWN"
+	}
+	if lw, ok := w.(*loggingResponseWriter); ok {
+		lw.command = command
+	}
+}
+
+// logRequests wraps next and logs one key=value line per request once it has
+// been handled. The duration includes any time spent blocked, so a BQPOP
+// logs how long it actually waited.
+func logRequests(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+
+		next(lw, r)
+
+		command := lw.command
+		if command == "" {
+			command = "-"
+		}
+		// The verb is quoted since a quoted token can hold spaces and
+		// newlines that would otherwise forge fields or whole lines
+		log.Printf("method=%s path=%s command=%q status=%d duration=%s",
+			r.Method, r.URL.Path, command, lw.status, time.Since(start))
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLogRequests(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		result  interface{}
+		want    string
+	}{
+		{"known verb", "GET", nil, `command="GET" `},
+		{"unknown verb", "FOO", unknownCommand("Invalid Command"), `command="UNKNOWN" `},
+		{"forged line", "X status=200\nmethod=POST", unknownCommand("Invalid Command"), `command="UNKNOWN" `},
+		{"no command", "", nil, `command="-" `},
+		{"verb with spaces", "A b=c", nil, `command="A b=c" `},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			defer log.SetOutput(log.Writer())
+			log.SetOutput(&buf)
+
+			handler := logRequests(func(w http.ResponseWriter, r *http.Request) {
+				if tt.command != "" {
+					recordCommand(w, tt.command, tt.result)
+				}
+			})
+			handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/command/", nil))
+
+			line := buf.String()
+			if strings.Count(line, "\n") != 1 || !strings.Contains(line, tt.want) {
+				t.Errorf("logged %q, want one line with %s", line, tt.want)
+			}
+		})
+	}
+}
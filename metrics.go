@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bqpopWaitBuckets are the upper bounds, in seconds, of the BQPOP wait
+// histogram exposed on /metrics
+var bqpopWaitBuckets = [...]float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60}
+
+// unknownCommand is the result ExecuteCommand gives for a verb it does not
+// recognise. It reads as the usual "Invalid Command", but keeps made-up verbs
+// from each getting their own metrics label.
+type unknownCommand string
+
+// metrics holds the counters behind /metrics. Everything is updated with
+// atomic operations, so recording never waits on the datastore lock.
+type metrics struct {
+	commands sync.Map // Verb to *int64
+	errors   sync.Map // Status code to *int64
+
+	bqpopWaits   [len(bqpopWaitBuckets) + 1]int64 // Per bucket, not cumulative, with +Inf last
+	bqpopWaitSum int64                            // Nanoseconds
+}
+
+// counter returns the counter for label in m, creating it on first use
+func counter(m *sync.Map, label interface{}) *int64 {
+	if c, ok := m.Load(label); ok {
+		return c.(*int64)
+	}
+	c, _ := m.LoadOrStore(label, new(int64))
+	return c.(*int64)
+}
+
+// observeCommand counts a finished command by verb and, if it failed, by
+// status
+func (m *metrics) observeCommand(command string, result interface{}, status int) {
+	if _, ok := result.(unknownCommand); ok {
+		command = "UNKNOWN"
+	}
+	atomic.AddInt64(counter(&m.commands, command), 1)
+	if status != http.StatusOK {
+		atomic.AddInt64(counter(&m.errors, status), 1)
+	}
+}
+
+// observeBQPOPWait records how long a BQPOP call waited, whether or not it
+// got a value
+func (m *metrics) observeBQPOPWait(wait time.Duration) {
+	bucket := sort.SearchFloat64s(bqpopWaitBuckets[:], wait.Seconds())
+	atomic.AddInt64(&m.bqpopWaits[bucket], 1)
+	atomic.AddInt64(&m.bqpopWaitSum, int64(wait))
+}
+
+// metricsLabelReplacer escapes label values for the text exposition format
+var metricsLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WriteMetrics writes the datastore's metrics to w in the Prometheus text
+// exposition format
+func (ds *Datastore) WriteMetrics(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	m := &ds.metrics
+
+	fmt.Fprintln(bw, "# HELP datastore_commands_total Commands executed, by verb.")
+	fmt.Fprintln(bw, "# TYPE datastore_commands_total counter")
+	commands := map[string]int64{}
+	m.commands.Range(func(verb, c interface{}) bool {
+		commands[verb.(string)] = atomic.LoadInt64(c.(*int64))
+		return true
+	})
+	verbs := make([]string, 0, len(commands))
+	for verb := range commands {
+		verbs = append(verbs, verb)
+	}
+	sort.Strings(verbs)
+	for _, verb := range verbs {
+		fmt.Fprintf(bw, "datastore_commands_total{command=\"%s\"} %d\n", metricsLabelReplacer.Replace(verb), commands[verb])
+	}
+
+	fmt.Fprintln(bw, "# HELP datastore_command_errors_total Commands that failed, by HTTP status.")
+	fmt.Fprintln(bw, "# TYPE datastore_command_errors_total counter")
+	errors := map[int]int64{}
+	m.errors.Range(func(status, c interface{}) bool {
+		errors[status.(int)] = atomic.LoadInt64(c.(*int64))
+		return true
+	})
+	statuses := make([]int, 0, len(errors))
+	for status := range errors {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(bw, "datastore_command_errors_total{status=\"%d\"} %d\n", status, errors[status])
+	}
+
+	fmt.Fprintln(bw, "# HELP datastore_keys Keys currently stored, not counting expired ones.")
+	fmt.Fprintln(bw, "# TYPE datastore_keys gauge")
+	fmt.Fprintf(bw, "datastore_keys %d\n", ds.DBSize())
+
+	fmt.Fprintln(bw, "# HELP datastore_bqpop_wait_seconds Time BQPOP calls spent waiting.")
+	fmt.Fprintln(bw, "# TYPE datastore_bqpop_wait_seconds histogram")
+	var cumulative int64
+	for i, bound := range bqpopWaitBuckets {
+		cumulative += atomic.LoadInt64(&m.bqpopWaits[i])
+		fmt.Fprintf(bw, "datastore_bqpop_wait_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	cumulative += atomic.LoadInt64(&m.bqpopWaits[len(bqpopWaitBuckets)])
+	fmt.Fprintf(bw, "datastore_bqpop_wait_seconds_bucket{le=\"+Inf\"} %d\n", cumulative)
+	sum := time.Duration(atomic.LoadInt64(&m.bqpopWaitSum)).Seconds()
+	fmt.Fprintf(bw, "datastore_bqpop_wait_seconds_sum %s\n", strconv.FormatFloat(sum, 'g', -1, 64))
+	fmt.Fprintf(bw, "datastore_bqpop_wait_seconds_count %d\n", cumulative)
+
+	return bw.Flush()
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// reservation is a queue value handed out by QRESERVE. It is hidden from
+// other consumers until it is acknowledged, or put back on the queue when
+// it is nacked or its deadline passes.
+type reservation struct {
+	item     queueItem
+	deadline time.Time
+}
+
+// QReserve pops the oldest value from the queue at key and holds it as a
+// reservation for visibility. The value comes back with an ID to pass to
+// QAck once it has been processed, or to QNack to give it up, and with the
+// number of times it has now been delivered. Reservations that lapse first
+// are returned to the queue.
+func (ds *Datastore) QReserve(key string, visibility time.Duration) (string, string, int, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if ok && !data.isQueued {
+		return "", wrongTypeMessage, 0, http.StatusConflict
+	}
+	if ok {
+		ds.requeueLapsed(key, data, time.Now())
+	}
+	if !ok || !data.hasVisible() {
+		return "", "Q is empty so nothing can be popped!!", 0, http.StatusBadRequest
+	}
+
+	item := data.popItems(1, false)[0]
+	item.deliveries++
+	ds.servePushers(key)
+
+	ds.reservations++
+	id := strconv.FormatUint(ds.reservations, 10)
+	if data.reserved == nil {
+		data.reserved = make(map[string]*reservation)
+	}
+	data.reserved[id] = &reservation{item: item, deadline: time.Now().Add(visibility)}
+	ds.reservedKeys[key] = struct{}{}
+
+	return id, item.value, item.deliveries, http.StatusOK
+}
+
+// QAck deletes the reserved value with the given ID for good. It returns 1,
+// or 0 with StatusNotFound when there is no such reservation, for instance
+// because it lapsed and the value went back on the queue. A lapsed
+// reservation that has not been returned yet can still be acknowledged.
+func (ds *Datastore) QAck(key, id string) (int, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, status := ds.reservedQueue(key, id)
+	if status != http.StatusOK {
+		return 0, status
+	}
+	delete(data.reserved, id)
+
+	return 1, http.StatusOK
+}
+
+// QNack returns the reserved value with the given ID to the front of its
+// queue so it is delivered next, or dead-letters it if it has run out of
+// deliveries. It returns 1, or 0 with StatusNotFound when there is no such
+// reservation.
+func (ds *Datastore) QNack(key, id string) (int, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, status := ds.reservedQueue(key, id)
+	if status != http.StatusOK {
+		return 0, status
+	}
+	item := data.reserved[id].item
+	delete(data.reserved, id)
+	ds.returnItems(key, data, []queueItem{item})
+
+	return 1, http.StatusOK
+}
+
+// reservedQueue looks up the queue at key and checks it holds reservation
+// id. The caller must hold the write lock.
+func (ds *Datastore) reservedQueue(key, id string) (*Data, int) {
+	data, ok := ds.lookup(key)
+	if !ok {
+		return nil, http.StatusNotFound
+	}
+	if !data.isQueued {
+		return nil, http.StatusConflict
+	}
+	if _, ok := data.reserved[id]; !ok {
+		return nil, http.StatusNotFound
+	}
+	return data, http.StatusOK
+}
+
+// RequeueLapsed returns every reserved value whose deadline has passed to the
+// front of its queue and reports how many there were. The expiry reaper calls
+// it on each cycle. Without the reaper, lapsed values go back only when the
+// next QRESERVE on their queue runs.
+func (ds *Datastore) RequeueLapsed() int {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	now := time.Now()
+	requeued := 0
+	for key := range ds.reservedKeys {
+		data, ok := ds.data[key]
+		if !ok || !data.isQueued || len(data.reserved) == 0 {
+			delete(ds.reservedKeys, key)
+			continue
+		}
+		ds.changed(key, data)
+		requeued += ds.requeueLapsed(key, data, now)
+	}
+
+	return requeued
+}
+
+// requeueLapsed returns the lapsed reservations of data, the queue at key,
+// earliest deadline first. The caller must hold the write lock.
+func (ds *Datastore) requeueLapsed(key string, data *Data, now time.Time) int {
+	var lapsed []*reservation
+	for id, r := range data.reserved {
+		if !now.Before(r.deadline) {
+			lapsed = append(lapsed, r)
+			delete(data.reserved, id)
+		}
+	}
+	if len(lapsed) == 0 {
+		return 0
+	}
+
+	ds.returnItems(key, data, sortReservations(lapsed))
+
+	return len(lapsed)
+}
+
+// returnItems puts items given up by consumers back at the front of data, the
+// queue at key, in order, and hands them to any waiters. Items that have used
+// up the queue's MaxDeliver are moved to its dead-letter queue instead,
+// unless that queue refuses them. The caller must hold the write lock.
+func (ds *Datastore) returnItems(key string, data *Data, items []queueItem) {
+	requeue := make([]queueItem, 0, len(items))
+	for _, item := range items {
+		if data.maxDeliveries > 0 && item.deliveries >= data.maxDeliveries && data.deadLetterKey != "" {
+			if _, status := ds.pushItemsLocked(data.deadLetterKey, false, time.Time{}, []queueItem{item}); status == http.StatusOK {
+				data.deadLettered++
+				continue
+			}
+		}
+		requeue = append(requeue, item)
+	}
+
+	data.queue = append(requeue, data.queue...)
+	ds.serveWaiters(key)
+}
+
+// reservedItems returns the items reserved from the queue, earliest deadline
+// first
+func (d *Data) reservedItems() []queueItem {
+	reserved := make([]*reservation, 0, len(d.reserved))
+	for _, r := range d.reserved {
+		reserved = append(reserved, r)
+	}
+	return sortReservations(reserved)
+}
+
+// sortReservations orders reservations by deadline and returns their items
+func sortReservations(reserved []*reservation) []queueItem {
+	sort.Slice(reserved, func(i, j int) bool { return reserved[i].deadline.Before(reserved[j].deadline) })
+
+	items := make([]queueItem, len(reserved))
+	for i, r := range reserved {
+		items[i] = r.item
+	}
+	return items
+}
+
+// QConfig sets the dead-letter queue and maximum deliveries of the queue at
+// key, creating an empty queue if the key is missing. Once a value reserved
+// with QRESERVE has been delivered maxDeliveries times, giving it up moves it
+// to the dead-letter queue instead of back onto this one. A maxDeliveries of
+// 0 turns this off. A nil argument leaves that setting unchanged.
+func (ds *Datastore) QConfig(key string, deadLetterKey *string, maxDeliveries *int) (string, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if ok && !data.isQueued {
+		return wrongTypeMessage, http.StatusConflict
+	}
+
+	dlq, max := "", 0
+	if ok {
+		dlq, max = data.deadLetterKey, data.maxDeliveries
+	}
+	if deadLetterKey != nil {
+		dlq = *deadLetterKey
+	}
+	if maxDeliveries != nil {
+		max = *maxDeliveries
+	}
+	if dlq == key {
+		return "a queue cannot be its own dead-letter queue", http.StatusBadRequest
+	}
+	if max > 0 && dlq == "" {
+		return "MAXDELIVER needs a DLQ", http.StatusBadRequest
+	}
+
+	if !ok {
+		data = &Data{isQueued: true, queue: []queueItem{}}
+		if !ds.makeRoom(key, func() int { return data.approxSize(key) }) {
+			return outOfMemoryMessage, http.StatusInsufficientStorage
+		}
+		ds.put(key, data)
+	}
+	data.deadLetterKey, data.maxDeliveries = dlq, max
+
+	return "OK", http.StatusOK
+}
+
+// QueueConfig is the dead-letter configuration of a queue, as reported by
+// QCONFIG with no options
+type QueueConfig struct {
+	DeadLetterKey string `json:"dlq"`
+	MaxDeliveries int    `json:"max_deliver"`
+	DeadLettered  int    `json:"dead_lettered"` // Values moved to the dead-letter queue so far
+}
+
+// QueueConfigOf returns the dead-letter configuration of the queue at key.
+// A missing key gives the zero config.
+func (ds *Datastore) QueueConfigOf(key string) (QueueConfig, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return QueueConfig{}, http.StatusOK
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return QueueConfig{}, http.StatusOK
+	}
+	if !data.isQueued {
+		return QueueConfig{}, http.StatusConflict
+	}
+	data.touch()
+
+	return QueueConfig{data.deadLetterKey, data.maxDeliveries, data.deadLettered}, http.StatusOK
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// Limits on what a RESP client can make the server read or allocate before
+// a command is even parsed. Bulk strings are further capped by
+// Options.MaxBodyBytes, which bounds a whole command.
+const (
+	MaxRESPArgs       = 1024 * 1024 // Elements in one command array, as in Redis
+	MaxRESPLineLength = 64 * 1024   // Length of an inline command or header line
+)
+
+var errRESPProtocol = errors.New("protocol error")
+
+// respLineReplacer keeps simple strings and errors on a single line
+var respLineReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+// ServeRESP accepts connections on ln and serves commands sent with the Redis
+// serialization protocol until ln is closed. Commands are dispatched through
+// ExecuteCommand, so both front-ends share the same Datastore.
+func (ds *Datastore) ServeRESP(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go ds.handleRESPConn(conn)
+	}
+}
+
+// respRead is a command read from a RESP connection, or the error that ended
+// reading
+type respRead struct {
+	args []string
+	err  error
+}
+
+func (ds *Datastore) handleRESPConn(conn net.Conn) {
+	defer conn.Close()
+	defer func() {
+		// One bad connection must not take the whole server down with it
+		if v := recover(); v != nil {
+			log.Printf("resp: panic serving %s: %v\n%s", conn.RemoteAddr(), v, debug.Stack())
+		}
+	}()
+
+	// Commands are read on their own goroutine so that a client hanging up
+	// is noticed while one of its commands blocks. The connection's context
+	// is then cancelled, which takes the command off the waiting lists
+	// before a value can be handed to a caller that is no longer there.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reads := make(chan respRead)
+	go func() {
+		r := bufio.NewReader(conn)
+		for {
+			args, err := readRESPCommand(r, ds.maxBodyBytes())
+			if err != nil && !errors.Is(err, errRESPProtocol) {
+				cancel()
+			}
+			select {
+			case reads <- respRead{args, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	w := bufio.NewWriter(conn)
+	authenticated := ds.opts.AuthToken == ""
+	for {
+		var read respRead
+		select {
+		case read = <-reads:
+		case <-ctx.Done():
+			return
+		}
+		if read.err != nil {
+			if errors.Is(read.err, errRESPProtocol) {
+				fmt.Fprintf(w, "-ERR %v\r\n", read.err)
+				w.Flush()
+			}
+			return
+		}
+		args := read.args
+		if len(args) == 0 {
+			continue
+		}
+
+		command := strings.ToUpper(args[0])
+		switch {
+		case command == "AUTH":
+			if len(args) == 2 && ds.opts.AuthToken != "" && ds.validToken(args[1]) {
+				authenticated = true
+				w.WriteString("+OK\r\n")
+			} else {
+				w.WriteString("-WRONGPASS invalid token\r\n")
+			}
+		case !authenticated:
+			w.WriteString("-NOAUTH Authentication required\r\n")
+		default:
+			result, status := ds.ExecuteCommand(ctx, command, args[1:])
+			writeRESPReply(w, result, status)
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// readRESPCommand reads either an array of bulk strings or an inline command.
+// The bulk strings of one command may add up to at most maxBytes. Nothing is
+// allocated on the strength of a length header alone beyond that.
+func readRESPCommand(r *bufio.Reader, maxBytes int64) ([]string, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > MaxRESPArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errRESPProtocol)
+	}
+
+	var args []string // Grown as elements arrive rather than sized from n
+	remaining := maxBytes
+	for i := 0; i < n; i++ {
+		header, err := readRESPLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(header, "$") {
+			return nil, fmt.Errorf("%w: expected '$', got %q", errRESPProtocol, header)
+		}
+		size, err := strconv.Atoi(header[1:])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("%w: invalid bulk length", errRESPProtocol)
+		}
+		if int64(size) > remaining {
+			return nil, fmt.Errorf("%w: command exceeds the maximum size", errRESPProtocol)
+		}
+		remaining -= int64(size)
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", errRESPProtocol)
+		}
+		args = append(args, string(buf[:size]))
+	}
+
+	return args, nil
+}
+
+// readRESPLine reads one CRLF terminated line of at most MaxRESPLineLength
+// bytes
+func readRESPLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > MaxRESPLineLength {
+			return "", fmt.Errorf("%w: line too long", errRESPProtocol)
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// respOKMessages are the messages write commands succeed with, which Redis
+// clients expect to see as a plain +OK
+var respOKMessages = map[string]bool{
+	"OK":                           true,
+	"Enter data sucessfull":        true,
+	"Value is pushed successfully": true,
+	"Key is renamed successfully":  true,
+	"Key is copied successfully":   true,
+	"Keys are merged successfully": true,
+	"All keys are flushed":         true,
+}
+
+// writeRESPReply converts a command result into its RESP equivalent. Single
+// entry JSON objects such as {"value": "x"} or {"count": 2} are unwrapped to a
+// bulk string or an integer, anything else structured is sent as JSON text.
+// Write successes are sent as +OK and a SET NX or XX whose condition is not
+// met as a null bulk string, as Redis clients expect.
+func writeRESPReply(w *bufio.Writer, result interface{}, status int) {
+	if status != http.StatusOK {
+		if n, ok := singleInteger(result); ok && status == http.StatusNotFound {
+			fmt.Fprintf(w, ":%d\r\n", n)
+			return
+		}
+		// An unmet SET condition gives an empty result rather than a reason
+		if status == http.StatusNotFound || (status == http.StatusConflict && result == "") {
+			w.WriteString("$-1\r\n")
+			return
+		}
+		fmt.Fprintf(w, "-ERR %s\r\n", respLineReplacer.Replace(errorMessage(result, status)))
+		return
+	}
+
+	switch v := result.(type) {
+	case string:
+		if respOKMessages[v] {
+			v = "OK"
+		}
+		fmt.Fprintf(w, "+%s\r\n", respLineReplacer.Replace(v))
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeRESPBulk(w, item)
+		}
+	case []string:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeRESPBulk(w, item)
+		}
+	case map[string]interface{}:
+		if len(v) == 1 {
+			for _, value := range v {
+				writeRESPReply(w, value, status)
+			}
+			return
+		}
+		writeRESPBulk(w, v)
+	case map[string]string:
+		if len(v) == 1 {
+			for _, value := range v {
+				writeRESPBulk(w, value)
+			}
+			return
+		}
+		writeRESPBulk(w, v)
+	default:
+		if n, ok := singleInteger(result); ok {
+			fmt.Fprintf(w, ":%d\r\n", n)
+			return
+		}
+		writeRESPBulk(w, v)
+	}
+}
+
+// writeRESPBulk writes value as a bulk string, nil as a null bulk string and
+// any non-string value as its JSON encoding
+func writeRESPBulk(w *bufio.Writer, value interface{}) {
+	var s string
+	switch v := value.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+		return
+	case string:
+		s = v
+	default:
+		encoded, _ := json.Marshal(v)
+		s = string(encoded)
+	}
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func singleInteger(result interface{}) (int64, bool) {
+	switch v := result.(type) {
+	case map[string]int:
+		for _, n := range v {
+			return int64(n), len(v) == 1
+		}
+	case map[string]int64:
+		for _, n := range v {
+			return n, len(v) == 1
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadRESPCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		maxBytes int64
+		want     []string
+		protocol bool // Whether a protocol error is expected
+	}{
+		{"array", "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", 1024, []string{"GET", "k"}, false},
+		{"inline", "GET k\r\n", 1024, []string{"GET", "k"}, false},
+		{"empty array", "*0\r\n", 1024, nil, false},
+		{"huge array header", "*4611686018427387904\r\n", 1024, nil, true},
+		{"array over the element cap", "*1048577\r\n", 1024, nil, true},
+		{"negative array header", "*-1\r\n", 1024, nil, true},
+		{"huge bulk length", "*1\r\n$9223372036854775807\r\n", 1024, nil, true},
+		{"bulk over the command cap", "*1\r\n$2048\r\n", 1024, nil, true},
+		{"bulks adding up past the cap", "*2\r\n$600\r\n" + strings.Repeat("a", 600) + "\r\n$600\r\n", 1024, nil, true},
+		{"inline line too long", strings.Repeat("a", MaxRESPLineLength+1) + "\r\n", 1024, nil, true},
+		{"unterminated bulk", "*1\r\n$1\r\nab\r\n", 1024, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readRESPCommand(bufio.NewReader(strings.NewReader(tt.input)), tt.maxBytes)
+			if tt.protocol {
+				if !errors.Is(err, errRESPProtocol) {
+					t.Fatalf("got %q, %v, want a protocol error", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// respRoundTrip sends request over a fresh RESP connection to ds and returns
+// the first reply line
+func respRoundTrip(t *testing.T, ds *Datastore, request string) string {
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go ds.handleRESPConn(server)
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go client.Write([]byte(request))
+
+	reply, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading reply to %q: %v", request, err)
+	}
+	return reply
+}
+
+func TestRESPRejectsOversizedHeaders(t *testing.T) {
+	ds := NewDatastore(Options{})
+
+	for _, request := range []string{
+		"*4611686018427387904\r\n",
+		"*1\r\n$536870912\r\n",
+	} {
+		if reply := respRoundTrip(t, ds, request); !strings.HasPrefix(reply, "-ERR protocol error") {
+			t.Errorf("reply to %q = %q, want a protocol error", request, reply)
+		}
+	}
+
+	// The server is still serving
+	if reply := respRoundTrip(t, ds, "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n"); !strings.HasPrefix(reply, "+") {
+		t.Errorf("SET after bad headers = %q, want a simple string", reply)
+	}
+}
+
+func TestRESPDisconnectReleasesBlockedCommands(t *testing.T) {
+	tests := []struct {
+		command string
+		waiting func(ds *Datastore) bool // Called with the write lock held
+		check   step                     // Run after pushing, to show the value was not taken
+	}{
+		{
+			"BQPOP q 0",
+			func(ds *Datastore) bool { return len(ds.waiters["q"]) == 1 },
+			step{"QLEN q", `{"capacity":0,"length":1,"visible":1}`, http.StatusOK},
+		},
+		{
+			"BQMOVE q dst 0",
+			func(ds *Datastore) bool { return len(ds.waiters["q"]) == 1 },
+			step{"QLEN q", `{"capacity":0,"length":1,"visible":1}`, http.StatusOK},
+		},
+		{
+			"BZPOPMIN z 0",
+			func(ds *Datastore) bool { return len(ds.waiters["z"]) == 1 },
+			step{"ZCARD z", `{"count":1}`, http.StatusOK},
+		},
+		{
+			"XREAD s $ BLOCK 0",
+			func(ds *Datastore) bool { return len(ds.streamReaders["s"]) == 1 },
+			step{"XLEN s", `{"length":1}`, http.StatusOK},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			ds := NewDatastore(Options{})
+			client, server := net.Pipe()
+			go ds.handleRESPConn(server)
+			if _, err := client.Write([]byte(tt.command + "\r\n")); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, ds, func() bool { return tt.waiting(ds) })
+
+			client.Close()
+			waitFor(t, ds, func() bool { return !tt.waiting(ds) })
+
+			for _, command := range []string{"QPUSH q v", "ZADD z 1 m", "XADD s v"} {
+				do(t, ds, command)
+			}
+			runSteps(t, ds, []step{tt.check})
+		})
+	}
+}
+
+func TestRESPRepliesToPipelinedCommandsBeforeHangingUp(t *testing.T) {
+	ds := NewDatastore(Options{})
+	client, server := net.Pipe()
+	go ds.handleRESPConn(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	go func() {
+		client.Write([]byte("SET a 1\r\nSET b 2\r\nGET a\r\n"))
+	}()
+	r := bufio.NewReader(client)
+	var replies []string
+	for i := 0; i < 4; i++ { // GET replies with a bulk string over two lines
+		reply, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading reply: %v", err)
+		}
+		replies = append(replies, strings.TrimSuffix(reply, "\r\n"))
+	}
+	if want := []string{"+OK", "+OK", "$1", "1"}; !reflect.DeepEqual(replies, want) {
+		t.Errorf("replies = %q, want %q", replies, want)
+	}
+	client.Close()
+	runSteps(t, ds, []step{{"EXISTS a b", `{"count":2}`, http.StatusOK}})
+}
+
+func TestRESPReplies(t *testing.T) {
+	tests := []struct {
+		setup   []string
+		request string
+		want    string // First line of the reply
+	}{
+		{nil, "SET k v\r\n", "+OK\r\n"},
+		{nil, "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n", "+OK\r\n"},
+		{nil, "SET k v NX\r\n", "+OK\r\n"},
+		{[]string{"SET k v"}, "SET k v2 NX\r\n", "$-1\r\n"},
+		{nil, "SET k v XX\r\n", "$-1\r\n"},
+		{[]string{"SET k v"}, "SET k v2 XX\r\n", "+OK\r\n"},
+		{[]string{"SET k v"}, "GET k\r\n", "$1\r\n"},
+		{nil, "GET k\r\n", "$-1\r\n"},
+		{nil, "QPUSH q a b\r\n", "+OK\r\n"},
+		{[]string{"QPUSH q a"}, "QPOP q\r\n", "$1\r\n"},
+		{[]string{"SET k v"}, "RENAME k k2\r\n", "+OK\r\n"},
+		{[]string{"QPUSH q a"}, "SET q v\r\n", "-ERR " + wrongTypeMessage + "\r\n"},
+		{nil, "EXISTS k\r\n", ":0\r\n"},
+	}
+
+	for _, tt := range tests {
+		ds := NewDatastore(Options{})
+		for _, command := range tt.setup {
+			ds.HandleCommand(context.Background(), command)
+		}
+		if got := respRoundTrip(t, ds, tt.request); got != tt.want {
+			t.Errorf("%v then %q = %q, want %q", tt.setup, tt.request, got, tt.want)
+		}
+	}
+}
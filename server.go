@@ -1,276 +1,3902 @@
-package main
-
-import (
-	"encoding/json"
-	"fmt"
-	"net/http"
-	"strconv"
-	"strings"
-	"sync"
-	"time"
-)
-
-const (
-	DefaultTimeoutSeconds = 10 // Default blocking queue read timeout in seconds
-)
-
-type Datastore struct {
-	mu   sync.Mutex
-	data map[string]*Data
-}
-
-type Data struct {
-	value    string
-	expiry   time.Time
-	isQueued bool
-	queue    []string
-}
-
-func NewDatastore() *Datastore {
-	return &Datastore{data: make(map[string]*Data)}
-}
-
-func (ds *Datastore) Set(key, value string, expirySeconds int, conditional string) (string, int) {
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
-
-	if _, ok := ds.data[key]; ok {
-		if conditional == "NX" { // If key already exists and NX flag is set, do not set value
-			return "", http.StatusConflict
-		}
-	} else if conditional == "XX" { // If key does not exist and XX flag is set, do not set value
-		return "", http.StatusNotFound
-	}
-
-	var expiry time.Time
-	if expirySeconds > 0 {
-		expiry = time.Now().Add(time.Duration(expirySeconds) * time.Second)
-	}
-
-	ds.data[key] = &Data{value: value, expiry: expiry, isQueued: false}
-
-	return "Enter data sucessfull", http.StatusOK
-}
-
-func (ds *Datastore) Get(key string) (string, int) {
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
-
-	if data, ok := ds.data[key]; ok {
-		if data.expiry.IsZero() || time.Now().Before(data.expiry) {
-			return data.value, http.StatusOK
-		}
-	}
-
-	return "Key not exist", http.StatusNotFound
-}
-
-func (ds *Datastore) QPush(key string, values ...string) (string, int) {
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
-
-	data := ds.data[key]
-	if data == nil {
-		data = &Data{isQueued: true, queue: []string{}}
-		ds.data[key] = data
-	} else if !data.isQueued {
-		// Key exists but is not a queue
-		return "Key already exists", http.StatusConflict
-	}
-
-	data.queue = append(data.queue, values...)
-
-	return "Value is pushed successfully", http.StatusOK
-}
-
-func (ds *Datastore) QPop(key string) (string, int) {
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
-
-	data := ds.data[key]
-	if data == nil || !data.isQueued || len(data.queue) == 0 {
-		return "Q is empty so nothing can be popped!!", http.StatusBadRequest
-	}
-
-	value := data.queue[len(data.queue)-1]
-	data.queue = data.queue[:len(data.queue)-1]
-
-	return value, http.StatusOK
-}
-
-func (ds *Datastore) BQPop(key string, timeoutSeconds float64) (string, int) {
-	timeout := time.Duration(time.Second * time.Duration(timeoutSeconds))
-	expiry := time.Now().Add(timeout)
-
-	for {
-		ds.mu.Lock()
-		data := ds.data[key]
-		if data == nil || !data.isQueued || len(data.queue) == 0 {
-			// Queue is empty
-			ds.mu.Unlock()
-
-			if time.Now().After(expiry) {
-				// Timeout expired
-				return "", http.StatusNotFound
-			}
-
-			time.Sleep(100 * time.Millisecond) // Wait before trying again
-			continue
-		}
-
-		value := data.queue[len(data.queue)-1]
-		data.queue = data.queue[:len(data.queue)-1]
-
-		ds.mu.Unlock()
-		return value, http.StatusOK
-	}
-}
-
-
-
-
-func (ds *Datastore) ValidateSetInput(args []string) bool {
-	if len(args) < 2 {
-		return false
-	}
-
-	if len(args) > 5 {
-		return false
-	}
-
-	if len(args) >= 4 && (!strings.HasPrefix(args[2], "EX") || len(args[2]) <= 2) {
-		return false
-	}
-
-	if len(args) == 5 && (args[4] != "NX" && args[4] != "XX") {
-		return false
-	}
-
-	return true
-}
-
-func (ds *Datastore) ValidateBQPopInput(args []string) bool {
-	if len(args) != 2 {
-		return false
-	}
-
-	if _, err := strconv.ParseFloat(args[1], 64); err != nil {
-		return false
-	}
-
-	return true
-}
-
-func (ds *Datastore) ParseCommand(rawCommand string) (string, []string) {
-	args := strings.Split(rawCommand, " ")
-	command := strings.ToUpper(args[0])
-	args = args[1:]
-
-	return command, args
-}
-
-func (ds *Datastore) HandleCommand(rawCommand string) (interface{}, int) {
-	command, args := ds.ParseCommand(rawCommand)
-
-	switch command {
-	case "SET":
-		if !ds.ValidateSetInput(args) {
-			return "Invalid Command", http.StatusBadRequest
-		}
-		key := args[0]
-		value := args[1]
-		var expirySeconds int
-		if len(args) >= 3 {
-			expirySeconds, _ = strconv.Atoi(args[2][2:])
-		}
-		conditional := ""
-		if len(args) == 5 {
-			conditional = args[4]
-		}
-		return ds.Set(key, value, expirySeconds, conditional)
-
-	case "GET":
-		if len(args) != 1 {
-			return "Invalid Command", http.StatusBadRequest
-		}
-		key := args[0];	value, status := ds.Get(key)
-		if status == http.StatusOK {
-			return map[string]string{"value": value}, status
-		}
-		return value, status
-
-	case "QPUSH":
-		if len(args) < 2 {
-			return nil, http.StatusBadRequest
-		}
-		key := args[0]
-		values := args[1:]
-		return ds.QPush(key, values...)
-
-	case "QPOP":
-		if len(args) != 1 {
-			return nil, http.StatusBadRequest
-		}
-		key := args[0]
-		value, status := ds.QPop(key)
-		if status == http.StatusOK {
-			return map[string]string{"value": value}, status
-		}
-		
-			return map[string]string{"error": value}, status
-	case "BQPOP":
-		if !ds.ValidateBQPopInput(args) {
-			return nil, http.StatusBadRequest
-		}
-		key := args[0]
-		timeoutSeconds, _ := strconv.ParseFloat(args[1], 64)
-		value, status := ds.BQPop(key, timeoutSeconds)
-		if status == http.StatusOK {
-			return map[string]string{"value": value}, status
-		}
-		return nil, status
-
-	default:
-		return "Invalid Command", http.StatusBadRequest
-	}
-}
-
-func main() {
-	datastore := NewDatastore()
-
-	http.HandleFunc("/command/", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-
-		contentType := r.Header.Get("Content-Type")
-		if contentType != "application/json" {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-
-		var jsonRequest struct {
-			Command string `json:"command"`
-		}
-		err := json.NewDecoder(r.Body).Decode(&jsonRequest)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-
-		result, status := datastore.HandleCommand(jsonRequest.Command)
-
-		if status == http.StatusOK {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(result)
-		} else {
-            w.Header().Set("Content-Type", "application/json")
-		    w.WriteHeader(status)
-		    json.NewEncoder(w).Encode(result)
-		}
-	})
-
-	fmt.Println("Starting server on port 8080...")
-	http.ListenAndServe(":8080", nil)
-}
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+)
+
+const (
+	DefaultTimeoutSeconds = 10          // Default blocking queue read timeout in seconds
+	DefaultSweepInterval  = time.Second // Default interval between expired key sweeps
+	DefaultSweepBatchSize = 20          // Default number of keys sampled per sweep burst
+	DefaultPort           = "8080"      // Default HTTP listen port
+	HealthCheckTimeout    = time.Second // How long /healthz waits for the datastore lock
+	ShutdownGracePeriod   = 10 * time.Second
+	DefaultKeysLimit      = 1000    // Default maximum number of keys returned by KEYS
+	DefaultScanCount      = 10      // Default number of keys returned per SCAN batch
+	MaxScanCount          = 1000    // Maximum COUNT accepted by SCAN
+	DefaultMaxValueBytes  = 1 << 20 // Default size limit of a string value
+	DefaultMaxBodyBytes   = 8 << 20 // Default size limit of an HTTP request body
+)
+
+const wrongTypeMessage = "WRONGTYPE Operation against a key holding the wrong kind of value"
+
+const outOfMemoryMessage = "OOM command not allowed when the memory limit is reached"
+
+const queueFullMessage = "queue is full"
+
+const valueTooLargeMessage = "value exceeds the maximum size"
+
+// Options configures a Datastore. The zero value gives an unbounded store.
+type Options struct {
+	KeysLimit  int  // Maximum number of keys returned by KEYS, 0 for no limit
+	AllowFlush bool // Whether FLUSHALL is permitted
+	MaxKeys    int  // Number of keys above which entries are evicted, 0 for no limit
+	MaxBytes   int  // Approximate memory above which entries are evicted, 0 for no limit
+
+	// EvictionPolicy picks what to evict once a limit is reached, one of
+	// the Eviction* constants. Empty means EvictionLRU.
+	EvictionPolicy string
+
+	// AuthToken, when set, must be presented by every HTTP request as a
+	// bearer token and by every RESP connection with AUTH before other
+	// commands. Empty leaves the server open.
+	AuthToken string
+
+	// MaxBlockTimeout caps how long a BQPOP may wait, including one asking to
+	// wait forever. Zero means no cap.
+	MaxBlockTimeout time.Duration
+
+	// MaxValueBytes caps the length of a string value written by SET, MSET,
+	// GETSET or APPEND. Zero means no cap.
+	MaxValueBytes int
+
+	// MaxBodyBytes caps the size of an HTTP request body, and the combined
+	// size of the arguments of one RESP command. Zero means
+	// DefaultMaxBodyBytes.
+	MaxBodyBytes int64
+}
+
+type Datastore struct {
+	mu        sync.RWMutex // Read-only operations only take the read lock
+	data      map[string]*Data
+	opts      Options
+	done      chan struct{} // Closed by Close to release blocked callers
+	closeOnce sync.Once
+	flushed   chan struct{} // Closed and replaced by FlushAll to release blocked callers
+	evictions int64         // Number of keys evicted to stay within limits
+	usedBytes int           // Approximate size of all entries, kept when MaxBytes is set
+	waiters   map[string][]*queueWaiter
+	pushers   map[string][]*pushWaiter
+
+	// resized holds the entries written since usedBytes was last brought up
+	// to date, whose size may have changed in place
+	resized map[string]*Data
+
+	streamReaders map[string][]chan struct{} // Wake channels of blocked XREAD callers
+
+	reservations uint64              // Last reservation ID handed out by QRESERVE
+	reservedKeys map[string]struct{} // Keys that may have reservations, for the reaper
+
+	// readyTimes holds the times at which delayed queue values become
+	// visible, earliest first, and readyTimer fires at the first of them.
+	// They are not tied to keys, so values moved by RENAME, COPY or QMOVE,
+	// or restored by LoadSnapshot, still wake blocked consumers.
+	readyTimes []time.Time
+	readyTimer *time.Timer
+
+	metrics metrics
+}
+
+// queueWaiter is a blocked BQPOP or BZPOPMIN caller. Pushes hand values
+// straight to waiters, oldest first, so the value and the key it came from
+// are stored on the waiter and wake is signalled once. wake is buffered so
+// serving a waiter never blocks.
+type queueWaiter struct {
+	keys   []string
+	zpop   bool    // Whether it waits on sorted sets rather than queues
+	score  float64 // Score of the popped member when zpop is set
+	back   bool    // Whether to pop from the back of the queue, or the highest score
+	moveTo string  // Queue the value is pushed onto when serving a BQMOVE
+	wake   chan struct{}
+	served bool
+	key    string
+	value  string // The popped value, or an error message if status is not OK
+	status int
+}
+
+// pushWaiter is a blocked BQPUSH caller. Once the queue has room for all of
+// values they are pushed on its behalf, in the order callers started waiting,
+// and the outcome is stored before wake is signalled.
+type pushWaiter struct {
+	key    string
+	values []string
+	wake   chan struct{}
+	served bool
+	result string
+	status int
+}
+
+type Data struct {
+	value     string
+	expiry    time.Time
+	isQueued  bool
+	queue     []queueItem
+	capacity  int                     // Maximum queue length, 0 for unbounded
+	trimToCap bool                    // Drop the oldest values instead of rejecting pushes past capacity
+	reserved  map[string]*reservation // Values handed out by QRESERVE, by reservation ID
+	isHash    bool
+	hash      map[string]string
+	isSet     bool
+	set       map[string]struct{}
+	isZSet    bool
+	zset      *sortedSet
+	isBitmap  bool
+	bits      []byte // Bit 0 is the most significant bit of the first byte
+	isHLL     bool
+	hll       *hyperLogLog
+	isStream  bool
+	stream    *stream
+
+	deadLetterKey string // Queue that values out of deliveries are moved to
+	maxDeliveries int    // Deliveries allowed before dead-lettering, 0 for unlimited
+	deadLettered  int    // Values moved to deadLetterKey so far
+
+	pushes, pops      int64     // Values pushed onto and popped from the queue so far
+	lastPush, lastPop time.Time // Zero until the first push or pop
+
+	counted int // Bytes counted for the entry in Datastore.usedBytes
+
+	lastAccess int64 // Unix nanoseconds, accessed atomically since reads only hold RLock
+	frequency  int64 // Decaying access counter for LFU eviction, accessed atomically
+}
+
+// queueItem is one value in a queue
+type queueItem struct {
+	value      string
+	pushedAt   time.Time // When the value first entered a queue, kept across moves
+	deliveries int       // Times the value has been handed out by QRESERVE
+	readyAt    time.Time // Set by QPUSH DELAY; the item is hidden from consumers until then
+}
+
+// visible reports whether the item can be consumed at now
+func (i queueItem) visible(now time.Time) bool {
+	return i.readyAt.IsZero() || !now.Before(i.readyAt)
+}
+
+// newQueueItems wraps freshly pushed values as queue items
+func newQueueItems(values []string) []queueItem {
+	now := time.Now()
+	items := make([]queueItem, len(values))
+	for i, value := range values {
+		items[i] = queueItem{value: value, pushedAt: now}
+	}
+	return items
+}
+
+// itemValues returns a copy of the values of items
+func itemValues(items []queueItem) []string {
+	values := make([]string, len(items))
+	for i, item := range items {
+		values[i] = item.value
+	}
+	return values
+}
+
+// touch records that the entry has just been used. Concurrent readers may
+// occasionally lose an increment, which is fine for an eviction heuristic.
+func (d *Data) touch() {
+	now := time.Now().UnixNano()
+	last := atomic.SwapInt64(&d.lastAccess, now)
+	freq := decayFrequency(atomic.LoadInt64(&d.frequency), now-last)
+	atomic.StoreInt64(&d.frequency, freq+1)
+}
+
+// isString reports whether the entry holds a plain string value
+func (d *Data) isString() bool {
+	return !d.isQueued && !d.isHash && !d.isSet && !d.isZSet && !d.isBitmap && !d.isHLL && !d.isStream
+}
+
+// maxBodyBytes returns Options.MaxBodyBytes, or DefaultMaxBodyBytes when it
+// is not set
+func (ds *Datastore) maxBodyBytes() int64 {
+	if ds.opts.MaxBodyBytes <= 0 {
+		return DefaultMaxBodyBytes
+	}
+	return ds.opts.MaxBodyBytes
+}
+
+// valueTooLarge reports whether a string value of size bytes is over
+// Options.MaxValueBytes
+func (ds *Datastore) valueTooLarge(size int) bool {
+	return ds.opts.MaxValueBytes > 0 && size > ds.opts.MaxValueBytes
+}
+
+// isExpired reports whether the entry has an expiry that has already passed
+func (d *Data) isExpired() bool {
+	return !d.expiry.IsZero() && !time.Now().Before(d.expiry)
+}
+
+// Rough per-entry and per-queue-item bookkeeping overhead in bytes, used for
+// approximate memory accounting
+const (
+	entryOverheadBytes       = 64
+	queueItemOverheadBytes   = 16
+	hashFieldOverheadBytes   = 32
+	setMemberOverheadBytes   = 16
+	zsetMemberOverheadBytes  = 48
+	streamEntryOverheadBytes = 40
+)
+
+// approxSize estimates the memory held by the entry stored under key
+func (d *Data) approxSize(key string) int {
+	size := entryOverheadBytes + len(key) + len(d.value) + len(d.bits)
+	for _, item := range d.queue {
+		size += queueItemOverheadBytes + len(item.value)
+	}
+	for _, r := range d.reserved {
+		size += queueItemOverheadBytes + len(r.item.value)
+	}
+	for field, value := range d.hash {
+		size += hashFieldOverheadBytes + len(field) + len(value)
+	}
+	for member := range d.set {
+		size += setMemberOverheadBytes + len(member)
+	}
+	if d.zset != nil {
+		for _, m := range d.zset.ordered {
+			size += zsetMemberOverheadBytes + len(m.Member)
+		}
+	}
+	if d.hll != nil {
+		size += hllRegisters
+	}
+	if d.stream != nil {
+		for _, e := range d.stream.entries {
+			size += streamEntryOverheadBytes + len(e.value)
+		}
+	}
+	return size
+}
+
+// trim drops values beyond the queue's capacity. The oldest values go, which
+// are at the back after a front push and at the front otherwise.
+func (d *Data) trim(front bool) {
+	excess := len(d.queue) - d.capacity
+	if d.capacity == 0 || excess <= 0 {
+		return
+	}
+	if front {
+		clear(d.queue[d.capacity:])
+		d.queue = d.queue[:d.capacity]
+	} else {
+		clear(d.queue[:excess])
+		d.queue = d.queue[excess:]
+	}
+}
+
+// pop removes up to count visible values from the front of the queue, or
+// from the back when back is set, and returns them in pop order. Delayed
+// values are skipped and keep their place.
+func (d *Data) pop(count int, back bool) []string {
+	return itemValues(d.popItems(count, back))
+}
+
+// popItems is pop returning whole items. The queue's start index moves
+// forward on a front pop, so no items are copied unless a delayed item is
+// in the way.
+func (d *Data) popItems(count int, back bool) []queueItem {
+	now := time.Now()
+	var items []queueItem
+	for len(items) < count {
+		i := d.nextVisible(back, now)
+		if i < 0 {
+			break
+		}
+		items = append(items, d.queue[i])
+		d.pops++
+		d.lastPop = now
+
+		switch last := len(d.queue) - 1; i {
+		case 0:
+			d.queue[0] = queueItem{} // Drop the reference; the backing array outlives the slice
+			d.queue = d.queue[1:]
+		case last:
+			d.queue = d.queue[:last]
+		default:
+			copy(d.queue[i:], d.queue[i+1:])
+			d.queue[last] = queueItem{}
+			d.queue = d.queue[:last]
+		}
+	}
+
+	return items
+}
+
+// nextVisible returns the index of the first item visible at now, counting
+// from the back when back is set, or -1 if every item is delayed
+func (d *Data) nextVisible(back bool, now time.Time) int {
+	for n := range d.queue {
+		i := n
+		if back {
+			i = len(d.queue) - 1 - n
+		}
+		if d.queue[i].visible(now) {
+			return i
+		}
+	}
+	return -1
+}
+
+// hasVisible reports whether the queue holds a value that can be popped now
+func (d *Data) hasVisible() bool {
+	return d.nextVisible(false, time.Now()) >= 0
+}
+
+// clone returns a deep copy of the entry so the copy shares no queue storage.
+// Reservations belong to the original and are not copied.
+func (d *Data) clone() *Data {
+	c := *d
+	c.queue = append([]queueItem(nil), d.queue...)
+	c.reserved = nil
+	if d.hash != nil {
+		c.hash = make(map[string]string, len(d.hash))
+		for field, value := range d.hash {
+			c.hash[field] = value
+		}
+	}
+	if d.set != nil {
+		c.set = make(map[string]struct{}, len(d.set))
+		for member := range d.set {
+			c.set[member] = struct{}{}
+		}
+	}
+	if d.zset != nil {
+		c.zset = d.zset.clone()
+	}
+	c.bits = append([]byte(nil), d.bits...)
+	if d.hll != nil {
+		hll := *d.hll
+		c.hll = &hll
+	}
+	if d.stream != nil {
+		c.stream = d.stream.clone()
+	}
+	return &c
+}
+
+// lookup returns the entry for key, removing it instead if it has expired.
+// Write paths use it, so the entry is assumed to be about to change. The
+// caller must hold the write lock.
+func (ds *Datastore) lookup(key string) (*Data, bool) {
+	data, ok := ds.data[key]
+	if ok && data.isExpired() {
+		ds.remove(key)
+		return nil, false
+	}
+	if ok {
+		data.touch()
+		ds.changed(key, data)
+	}
+	return data, ok
+}
+
+// put stores data under key and marks it as just used. The caller must hold
+// the write lock.
+func (ds *Datastore) put(key string, data *Data) {
+	data.touch()
+	ds.remove(key)
+	data.counted = 0
+	ds.data[key] = data
+	ds.changed(key, data)
+}
+
+// remove deletes the entry at key, if any. The caller must hold the write
+// lock.
+func (ds *Datastore) remove(key string) {
+	if data, ok := ds.data[key]; ok {
+		ds.usedBytes -= data.counted
+		delete(ds.data, key)
+	}
+}
+
+// purgeExpired removes those of keys that are still expired. Read-only
+// operations call it after releasing the read lock so they can stay on RLock.
+func (ds *Datastore) purgeExpired(keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	for _, key := range keys {
+		if data, ok := ds.data[key]; ok && data.isExpired() {
+			ds.remove(key)
+		}
+	}
+}
+
+func NewDatastore(opts Options) *Datastore {
+	return &Datastore{
+		data:    make(map[string]*Data),
+		opts:    opts,
+		done:    make(chan struct{}),
+		flushed: make(chan struct{}),
+		waiters: make(map[string][]*queueWaiter),
+		pushers: make(map[string][]*pushWaiter),
+		resized: make(map[string]*Data),
+
+		streamReaders: make(map[string][]chan struct{}),
+		reservedKeys:  make(map[string]struct{}),
+	}
+}
+
+// Close stops background work and makes blocked BQPOP callers return
+func (ds *Datastore) Close() {
+	ds.closeOnce.Do(func() { close(ds.done) })
+}
+
+// Set stores value at key. A zero expiry means the key never expires and an
+// expiry in the past removes the key right away. When keepTTL is set the
+// expiry of the existing entry is carried over instead. Any other type is
+// only replaced by a string when force is set. Values longer than
+// Options.MaxValueBytes are refused with StatusRequestEntityTooLarge.
+func (ds *Datastore) Set(key, value string, opts setOptions) (string, int) {
+	if ds.valueTooLarge(len(value)) {
+		return valueTooLargeMessage, http.StatusRequestEntityTooLarge
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	expiry := opts.expiry
+	if existing, ok := ds.lookup(key); ok {
+		if !existing.isString() && !opts.force {
+			return wrongTypeMessage, http.StatusConflict
+		}
+		if opts.keepTTL {
+			expiry = existing.expiry
+		}
+		if opts.conditional == "NX" { // If key already exists and NX flag is set, do not set value
+			return "", http.StatusConflict
+		}
+	} else if opts.conditional == "XX" { // If key does not exist and XX flag is set, do not set value
+		return "", http.StatusNotFound
+	}
+
+	if !expiry.IsZero() && !time.Now().Before(expiry) {
+		ds.remove(key)
+		return "Enter data sucessfull", http.StatusOK
+	}
+
+	data := &Data{value: value, expiry: expiry, isQueued: false}
+	if !ds.makeRoom(key, func() int { return data.approxSize(key) }) {
+		return outOfMemoryMessage, http.StatusInsufficientStorage
+	}
+	ds.put(key, data)
+
+	return "Enter data sucessfull", http.StatusOK
+}
+
+func (ds *Datastore) Get(key string) (string, int) {
+	ds.mu.RLock()
+	data, ok := ds.data[key]
+	if ok && !data.isExpired() {
+		data.touch()
+		value := data.value
+		if data.isBitmap {
+			value = hex.EncodeToString(data.bits) // Raw bytes would not survive JSON
+		}
+		ds.mu.RUnlock()
+		return value, http.StatusOK
+	}
+	ds.mu.RUnlock()
+
+	if ok {
+		ds.purgeExpired(key)
+	}
+
+	return "key does not exist", http.StatusNotFound
+}
+
+// MSet stores alternating key/value pairs under a single lock acquisition.
+// Either every pair is applied or, if any key holds another type or there is
+// no room for them all, none is. None of the keys get an expiry.
+func (ds *Datastore) MSet(pairs ...string) (string, int) {
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return "Invalid Command", http.StatusBadRequest
+	}
+	for i := 1; i < len(pairs); i += 2 {
+		if ds.valueTooLarge(len(pairs[i])) {
+			return valueTooLargeMessage, http.StatusRequestEntityTooLarge
+		}
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	for i := 0; i < len(pairs); i += 2 {
+		if data, ok := ds.lookup(pairs[i]); ok && !data.isString() {
+			return wrongTypeMessage, http.StatusConflict
+		}
+	}
+
+	// Room is made for every pair before any is written, so running out
+	// leaves all of the keys as they were
+	sizes := make(map[string]int, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		sizes[pairs[i]] = (&Data{value: pairs[i+1]}).approxSize(pairs[i])
+	}
+	if !ds.makeRoomFor(sizes) {
+		return outOfMemoryMessage, http.StatusInsufficientStorage
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		ds.put(pairs[i], &Data{value: pairs[i+1]})
+	}
+
+	return "Enter data sucessfull", http.StatusOK
+}
+
+// MGet returns the values of keys in request order, with nil for keys that
+// are missing, expired or not strings.
+func (ds *Datastore) MGet(keys ...string) ([]interface{}, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		data, ok := ds.data[key]
+		if ok && data.isExpired() {
+			expired = append(expired, key)
+		} else if ok && data.isString() {
+			data.touch()
+			values[i] = data.value
+		}
+	}
+
+	return values, http.StatusOK
+}
+
+// TTL returns the remaining whole seconds before key expires, rounded up.
+// It follows Redis conventions: -1 for a key without expiry and -2 for a
+// missing or expired key.
+func (ds *Datastore) TTL(key string) (int, int) {
+	ttl, status := ds.ttlIn(key, time.Second)
+	return int(ttl), status
+}
+
+// PTTL is like TTL but reports milliseconds
+func (ds *Datastore) PTTL(key string) (int64, int) {
+	return ds.ttlIn(key, time.Millisecond)
+}
+
+// ttlIn returns the remaining time to live of key in multiples of unit
+func (ds *Datastore) ttlIn(key string, unit time.Duration) (int64, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return -2, http.StatusNotFound
+	}
+	if data.expiry.IsZero() {
+		return -1, http.StatusOK
+	}
+
+	// Measure once so a key expiring right now is reported as missing
+	remaining := time.Until(data.expiry)
+	if remaining <= 0 {
+		expired = append(expired, key)
+		return -2, http.StatusNotFound
+	}
+
+	// Round up without adding to remaining, which may be near the largest
+	// Duration
+	ttl := remaining / unit
+	if remaining%unit != 0 {
+		ttl++
+	}
+	return int64(ttl), http.StatusOK
+}
+
+// GetSet stores value at key and returns the previous value. The expiry is
+// reset unless keepTTL is set. The new value is stored even when the key did
+// not exist before, in which case StatusNotFound is returned.
+func (ds *Datastore) GetSet(key, value string, keepTTL bool) (string, int) {
+	if ds.valueTooLarge(len(value)) {
+		return valueTooLargeMessage, http.StatusRequestEntityTooLarge
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if ok && !data.isString() {
+		return wrongTypeMessage, http.StatusConflict
+	}
+	if !ds.makeRoom(key, func() int { return (&Data{value: value}).approxSize(key) }) {
+		return outOfMemoryMessage, http.StatusInsufficientStorage
+	}
+	if !ok {
+		ds.put(key, &Data{value: value})
+		return "Key not exist", http.StatusNotFound
+	}
+
+	old := data.value
+	data.value = value
+	if !keepTTL {
+		data.expiry = time.Time{}
+	}
+
+	return old, http.StatusOK
+}
+
+// GetDel returns the value at key and removes the key in one step
+func (ds *Datastore) GetDel(key string) (string, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if !ok {
+		return "Key not exist", http.StatusNotFound
+	}
+	if !data.isString() {
+		return wrongTypeMessage, http.StatusConflict
+	}
+
+	ds.remove(key)
+
+	return data.value, http.StatusOK
+}
+
+// IncrBy adds delta to the integer stored at key, treating a missing key as 0.
+// Any existing expiry is kept. Non-integer values are rejected as a bad
+// request and queue keys as a conflict.
+func (ds *Datastore) IncrBy(key string, delta int64) (int64, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if !ok {
+		data = &Data{value: "0"}
+	} else if !data.isString() {
+		return 0, http.StatusConflict
+	}
+
+	current, err := strconv.ParseInt(data.value, 10, 64)
+	if err != nil {
+		return 0, http.StatusBadRequest
+	}
+
+	next := current + delta
+	if (delta > 0 && next < current) || (delta < 0 && next > current) {
+		return 0, http.StatusBadRequest // Overflow
+	}
+	if !ok {
+		if !ds.makeRoom(key, func() int { return data.approxSize(key) }) {
+			return 0, http.StatusInsufficientStorage
+		}
+		ds.put(key, data)
+	}
+	data.value = strconv.FormatInt(next, 10)
+
+	return next, http.StatusOK
+}
+
+func (ds *Datastore) Incr(key string) (int64, int) {
+	return ds.IncrBy(key, 1)
+}
+
+func (ds *Datastore) Decr(key string) (int64, int) {
+	return ds.IncrBy(key, -1)
+}
+
+// Append concatenates value onto the string at key, creating it when missing,
+// and returns the new length. Any existing expiry is kept. A result longer
+// than Options.MaxValueBytes is refused with StatusRequestEntityTooLarge.
+func (ds *Datastore) Append(key, value string) (int, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if !ok {
+		data = &Data{}
+	} else if !data.isString() {
+		return 0, http.StatusConflict
+	}
+	if ds.valueTooLarge(len(data.value) + len(value)) {
+		return 0, http.StatusRequestEntityTooLarge
+	}
+
+	if !ds.makeRoom(key, func() int { return data.approxSize(key) + len(value) }) {
+		return 0, http.StatusInsufficientStorage
+	}
+	if !ok {
+		ds.put(key, data)
+	}
+	data.value += value
+
+	return len(data.value), http.StatusOK
+}
+
+// StrLen returns the length of the string at key in bytes, not characters.
+// A missing key gives 0 with StatusNotFound.
+func (ds *Datastore) StrLen(key string) (int, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return 0, http.StatusNotFound
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return 0, http.StatusNotFound
+	}
+	if !data.isString() {
+		return 0, http.StatusConflict
+	}
+
+	return len(data.value), http.StatusOK
+}
+
+// QPush appends values to the queue. A non-zero expiry sets or refreshes the
+// queue's TTL, otherwise any TTL it already has is kept.
+func (ds *Datastore) QPush(key string, expiry time.Time, values ...string) (string, int) {
+	return ds.push(key, false, expiry, values)
+}
+
+// QPushDelayed is QPush for values that stay hidden from consumers until
+// delay has passed. Until then they keep their place in the queue but are
+// skipped by pops, and once it passes any blocked consumers are served,
+// wherever the values are by then.
+func (ds *Datastore) QPushDelayed(key string, expiry time.Time, delay time.Duration, values ...string) (string, int) {
+	if delay <= 0 {
+		return ds.QPush(key, expiry, values...)
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	items := newQueueItems(values)
+	readyAt := time.Now().Add(delay)
+	for i := range items {
+		items[i].readyAt = readyAt
+	}
+
+	result, status := ds.pushItemsLocked(key, false, expiry, items)
+	if status == http.StatusOK {
+		ds.scheduleReady(readyAt)
+	}
+
+	return result, status
+}
+
+// scheduleReady arranges for blocked consumers to be served at at, when
+// delayed values become visible. The caller must hold the write lock.
+func (ds *Datastore) scheduleReady(at time.Time) {
+	if !at.After(time.Now()) {
+		return
+	}
+	i := sort.Search(len(ds.readyTimes), func(i int) bool { return !ds.readyTimes[i].Before(at) })
+	if i < len(ds.readyTimes) && ds.readyTimes[i].Equal(at) {
+		return
+	}
+	ds.readyTimes = append(ds.readyTimes, time.Time{})
+	copy(ds.readyTimes[i+1:], ds.readyTimes[i:])
+	ds.readyTimes[i] = at
+	if i == 0 {
+		ds.armReadyTimer()
+	}
+}
+
+// armReadyTimer sets readyTimer for the earliest of readyTimes. The caller
+// must hold the write lock.
+func (ds *Datastore) armReadyTimer() {
+	if ds.readyTimer != nil {
+		ds.readyTimer.Stop()
+		ds.readyTimer = nil
+	}
+	if len(ds.readyTimes) > 0 {
+		ds.readyTimer = time.AfterFunc(time.Until(ds.readyTimes[0]), ds.serveReady)
+	}
+}
+
+// serveReady drops the ready times that have passed and serves the callers
+// blocked on every key, since the values that just became visible may have
+// moved since they were pushed. A timer replaced while it was waiting for
+// the lock only repeats that harmlessly.
+func (ds *Datastore) serveReady() {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	now := time.Now()
+	passed := 0
+	for passed < len(ds.readyTimes) && !ds.readyTimes[passed].After(now) {
+		passed++
+	}
+	ds.readyTimes = ds.readyTimes[passed:]
+
+	keys := make([]string, 0, len(ds.waiters))
+	for key := range ds.waiters {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		ds.serveWaiters(key)
+	}
+	ds.armReadyTimer()
+}
+
+// QPushFront puts values at the head of the queue in the order given, so the
+// next pop returns values[0]. It is meant for re-queuing an item for retry.
+func (ds *Datastore) QPushFront(key string, values ...string) (string, int) {
+	return ds.push(key, true, time.Time{}, values)
+}
+
+func (ds *Datastore) push(key string, front bool, expiry time.Time, values []string) (string, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	return ds.pushLocked(key, front, expiry, values)
+}
+
+// pushLocked does the work of push. The caller must hold the write lock.
+func (ds *Datastore) pushLocked(key string, front bool, expiry time.Time, values []string) (string, int) {
+	return ds.pushItemsLocked(key, front, expiry, newQueueItems(values))
+}
+
+// pushItemsLocked is pushLocked for items that may already have been
+// delivered. The caller must hold the write lock.
+func (ds *Datastore) pushItemsLocked(key string, front bool, expiry time.Time, items []queueItem) (string, int) {
+	data, ok := ds.lookup(key)
+	if !ok {
+		data = &Data{isQueued: true, queue: []queueItem{}}
+	} else if !data.isQueued {
+		// Key exists but is not a queue
+		return wrongTypeMessage, http.StatusConflict
+	}
+	if data.capacity > 0 && !data.trimToCap && len(data.queue)+len(items) > data.capacity {
+		return queueFullMessage, http.StatusTooManyRequests
+	}
+
+	size := func() int {
+		size := data.approxSize(key)
+		for _, item := range items {
+			size += queueItemOverheadBytes + len(item.value)
+		}
+		return size
+	}
+	if !ds.makeRoom(key, size) {
+		return outOfMemoryMessage, http.StatusInsufficientStorage
+	}
+	if !ok {
+		ds.put(key, data)
+	}
+	if front {
+		data.queue = append(append([]queueItem{}, items...), data.queue...)
+	} else {
+		data.queue = append(data.queue, items...)
+	}
+	data.pushes += int64(len(items))
+	data.lastPush = time.Now()
+	if !expiry.IsZero() {
+		data.expiry = expiry
+	}
+	ds.serveWaiters(key)
+	if data.trimToCap {
+		data.trim(front)
+	}
+
+	return "Value is pushed successfully", http.StatusOK
+}
+
+// QCap bounds the queue at key to capacity values, creating an empty queue
+// if the key is missing. Once full, pushes are rejected, or with trim set
+// they go ahead and the oldest values are dropped to make room. A capacity
+// of 0 removes the bound.
+func (ds *Datastore) QCap(key string, capacity int, trim bool) (string, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if !ok {
+		data = &Data{isQueued: true, queue: []queueItem{}}
+		if !ds.makeRoom(key, func() int { return data.approxSize(key) }) {
+			return outOfMemoryMessage, http.StatusInsufficientStorage
+		}
+		ds.put(key, data)
+	} else if !data.isQueued {
+		return wrongTypeMessage, http.StatusConflict
+	}
+
+	data.capacity = capacity
+	data.trimToCap = trim && capacity > 0
+	if data.trimToCap {
+		data.trim(false)
+	}
+
+	ds.servePushers(key)
+
+	return "OK", http.StatusOK
+}
+
+// QCapacity returns the bound set by QCap, 0 when the queue is unbounded or
+// the key is missing
+func (ds *Datastore) QCapacity(key string) (int, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return 0, http.StatusOK
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return 0, http.StatusOK
+	}
+	if !data.isQueued {
+		return 0, http.StatusConflict
+	}
+
+	return data.capacity, http.StatusOK
+}
+
+// QPop removes the oldest value from the queue, or the newest when back is
+// set.
+func (ds *Datastore) QPop(key string, back bool) (string, int) {
+	values, status := ds.QPopN(key, 1, back)
+	return values[0], status
+}
+
+// QPopFront removes the oldest value from the head of the queue, as QPOP
+// does by default
+func (ds *Datastore) QPopFront(key string) (string, int) {
+	return ds.QPop(key, false)
+}
+
+// QPopBack removes the newest value from the tail of the queue, so the queue
+// can be used as a stack
+func (ds *Datastore) QPopBack(key string) (string, int) {
+	return ds.QPop(key, true)
+}
+
+// QPopN pops up to count values in one step and returns them in pop order.
+// On failure the only value is the error message.
+func (ds *Datastore) QPopN(key string, count int, back bool) ([]string, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if !ok || !data.isQueued || !data.hasVisible() {
+		return []string{"Q is empty so nothing can be popped!!"}, http.StatusBadRequest
+	}
+
+	values := data.pop(count, back)
+	ds.servePushers(key)
+
+	return values, http.StatusOK
+}
+
+// QPeek returns the value the next QPOP would return without removing it
+func (ds *Datastore) QPeek(key string) (string, int) {
+	values, status := ds.QPeekN(key, 1)
+	if status != http.StatusOK {
+		return values[0], status
+	}
+	if len(values) == 0 {
+		return "Q is empty", http.StatusNotFound
+	}
+
+	return values[0], http.StatusOK
+}
+
+// QPeekN returns up to count visible values from the pop end of the queue, in
+// pop order, without removing them. On failure the only value is the error
+// message.
+func (ds *Datastore) QPeekN(key string, count int) ([]string, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return []string{"Key not exist"}, http.StatusNotFound
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return []string{"Key not exist"}, http.StatusNotFound
+	}
+	if !data.isQueued {
+		return []string{wrongTypeMessage}, http.StatusConflict
+	}
+
+	now := time.Now()
+	values := make([]string, 0, min(count, len(data.queue)))
+	for _, item := range data.queue {
+		if len(values) == count {
+			break
+		}
+		if item.visible(now) {
+			values = append(values, item.value)
+		}
+	}
+
+	return values, http.StatusOK
+}
+
+// QRange returns a copy of the queue values between start and stop inclusive.
+// Negative indices count from the end (-1 is the last value) and out of range
+// indices are clamped. A missing key gives an empty result.
+func (ds *Datastore) QRange(key string, start, stop int) ([]string, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return []string{}, http.StatusOK
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return []string{}, http.StatusOK
+	}
+	if !data.isQueued {
+		return nil, http.StatusConflict
+	}
+
+	start, stop, ok = clampRange(start, stop, len(data.queue))
+	if !ok {
+		return []string{}, http.StatusOK
+	}
+
+	return itemValues(data.queue[start : stop+1]), http.StatusOK
+}
+
+// QTrim keeps only the queue values between start and stop inclusive, using
+// the same index rules as QRange. The kept values are copied to a new slice
+// so the memory of the discarded ones is released. Trimming a missing key
+// does nothing, and a range that selects nothing empties the queue.
+func (ds *Datastore) QTrim(key string, start, stop int) (string, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if !ok {
+		return "OK", http.StatusOK
+	}
+	if !data.isQueued {
+		return wrongTypeMessage, http.StatusConflict
+	}
+
+	start, stop, ok = clampRange(start, stop, len(data.queue))
+	if !ok {
+		data.queue = []queueItem{}
+		ds.servePushers(key)
+		return "OK", http.StatusOK
+	}
+	data.queue = append([]queueItem{}, data.queue[start:stop+1]...)
+	ds.servePushers(key)
+
+	return "OK", http.StatusOK
+}
+
+// QRem removes up to count values equal to value from the queue, scanning from
+// the head, or from the tail when count is negative. A count of zero removes
+// every match. The remaining values keep their order and the number removed
+// is returned. A missing key removes nothing.
+func (ds *Datastore) QRem(key string, count int, value string) (int, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if !ok {
+		return 0, http.StatusOK
+	}
+	if !data.isQueued {
+		return 0, http.StatusConflict
+	}
+
+	limit := count
+	if limit < 0 {
+		limit = -limit
+	}
+	matches := func(v string, removed int) bool {
+		return v == value && (limit == 0 || removed < limit)
+	}
+
+	queue := data.queue
+	removed := 0
+	if count >= 0 {
+		kept := queue[:0]
+		for _, item := range queue {
+			if matches(item.value, removed) {
+				removed++
+				continue
+			}
+			kept = append(kept, item)
+		}
+		clear(queue[len(kept):])
+		data.queue = kept
+	} else {
+		// Compact towards the tail so the scan can run backwards in one pass
+		next := len(queue)
+		for i := len(queue) - 1; i >= 0; i-- {
+			if matches(queue[i].value, removed) {
+				removed++
+				continue
+			}
+			next--
+			queue[next] = queue[i]
+		}
+		clear(queue[:next])
+		data.queue = queue[next:]
+	}
+
+	ds.servePushers(key)
+
+	return removed, http.StatusOK
+}
+
+// clampRange converts Redis style inclusive indices, which may be negative,
+// into valid indices for a sequence of length n. ok is false when the range
+// is empty.
+func clampRange(start, stop, n int) (int, int, bool) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop || start >= n {
+		return 0, 0, false
+	}
+	return start, stop, true
+}
+
+// QLen returns the number of values in the queue, how many of those are
+// visible rather than delayed, and the capacity set by QCap, 0 when
+// unbounded. All are 0 if the key is missing.
+func (ds *Datastore) QLen(key string) (length, visible, capacity, status int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return 0, 0, 0, http.StatusOK
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return 0, 0, 0, http.StatusOK
+	}
+	if !data.isQueued {
+		return 0, 0, 0, http.StatusConflict
+	}
+
+	now := time.Now()
+	for _, item := range data.queue {
+		if item.visible(now) {
+			visible++
+		}
+	}
+
+	return len(data.queue), visible, data.capacity, http.StatusOK
+}
+
+// QueueStats describes the health of one queue, as reported by QSTAT
+type QueueStats struct {
+	Key              string     `json:"key"`
+	Length           int        `json:"length"`
+	Capacity         int        `json:"capacity"`           // 0 for unbounded
+	InFlight         int        `json:"in_flight"`          // Reserved with QRESERVE and not yet acknowledged
+	DeadLettered     int        `json:"dead_lettered"`      // Moved to the dead-letter queue
+	Pushes           int64      `json:"pushes"`             // Values pushed since the queue was created
+	Pops             int64      `json:"pops"`               // Values popped, moved or reserved since then
+	BlockedWaiters   int        `json:"blocked_waiters"`    // Callers blocked in BQPOP or BQMOVE
+	BlockedPushers   int        `json:"blocked_pushers"`    // Callers blocked in BQPUSH
+	OldestAgeSeconds float64    `json:"oldest_age_seconds"` // Age of the longest queued value, 0 when empty
+	LastPush         *time.Time `json:"last_push,omitempty"`
+	LastPop          *time.Time `json:"last_pop,omitempty"`
+}
+
+// QStat returns the statistics of the queue at key
+func (ds *Datastore) QStat(key string) (QueueStats, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return QueueStats{}, http.StatusNotFound
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return QueueStats{}, http.StatusNotFound
+	}
+	if !data.isQueued {
+		return QueueStats{}, http.StatusConflict
+	}
+
+	return ds.queueStats(key, data, time.Now()), http.StatusOK
+}
+
+// QStatAll returns the statistics of every queue, sorted by key
+func (ds *Datastore) QStatAll() []QueueStats {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	now := time.Now()
+	stats := []QueueStats{}
+	for key, data := range ds.data {
+		if data.isQueued && !data.isExpired() {
+			stats = append(stats, ds.queueStats(key, data, now))
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Key < stats[j].Key })
+
+	return stats
+}
+
+// queueStats gathers the statistics of data, the queue at key. The caller
+// must hold at least the read lock.
+func (ds *Datastore) queueStats(key string, data *Data, now time.Time) QueueStats {
+	stats := QueueStats{
+		Key:            key,
+		Length:         len(data.queue),
+		Capacity:       data.capacity,
+		InFlight:       len(data.reserved),
+		DeadLettered:   data.deadLettered,
+		Pushes:         data.pushes,
+		Pops:           data.pops,
+		BlockedWaiters: len(ds.waiters[key]),
+		BlockedPushers: len(ds.pushers[key]),
+	}
+
+	var oldest time.Time
+	for _, item := range data.queue {
+		if !item.pushedAt.IsZero() && (oldest.IsZero() || item.pushedAt.Before(oldest)) {
+			oldest = item.pushedAt
+		}
+	}
+	if !oldest.IsZero() {
+		stats.OldestAgeSeconds = now.Sub(oldest).Seconds()
+	}
+	if !data.lastPush.IsZero() {
+		lastPush := data.lastPush
+		stats.LastPush = &lastPush
+	}
+	if !data.lastPop.IsZero() {
+		lastPop := data.lastPop
+		stats.LastPop = &lastPop
+	}
+
+	return stats
+}
+
+// BQPop pops from the first of keys, in the given order, whose queue has a
+// value, waiting up to timeoutSeconds for one to appear. It returns the key
+// the value came from along with the value, taken from the back of the queue
+// when back is set. A caller that has to wait joins a FIFO list of waiters on
+// every key and pushes hand values to those waiters in the order they started
+// waiting. A timeout of zero waits until a value arrives or the datastore is
+// closed or flushed. Either way the wait is capped at Options.MaxBlockTimeout
+// when that is set. Cancelling ctx, as happens when an HTTP client goes
+// away, ends the wait with StatusRequestTimeout.
+func (ds *Datastore) BQPop(ctx context.Context, keys []string, timeoutSeconds float64, back bool) (string, string, int) {
+	start := time.Now()
+	defer func() { ds.metrics.observeBQPOPWait(time.Since(start)) }()
+
+	expired, stop := ds.blockTimer(timeoutSeconds)
+	defer stop()
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	// A queue with visible values never has waiters, since pushes and
+	// maturing delays serve them first, so taking a value here can't jump
+	// ahead of anyone
+	for _, key := range keys {
+		data, ok := ds.lookup(key)
+		if !ok || !data.isQueued || !data.hasVisible() {
+			continue
+		}
+
+		value := data.pop(1, back)[0]
+		ds.servePushers(key)
+
+		return key, value, http.StatusOK
+	}
+
+	w := &queueWaiter{keys: keys, back: back, wake: make(chan struct{}, 1)}
+	ds.addWaiter(w)
+
+	status := ds.block(ctx, w.wake, expired)
+
+	// A value handed over just as the wait ended is still returned, so it
+	// is never lost
+	if w.served {
+		return w.key, w.value, w.status
+	}
+	ds.removeWaiter(w)
+
+	return "", "", status
+}
+
+func (ds *Datastore) Del(keys ...string) (int, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	deleted := 0
+	for _, key := range keys {
+		// Expired keys are still present in the map, so they are removed too
+		if _, ok := ds.data[key]; ok {
+			ds.remove(key)
+			deleted++
+			ds.servePushers(key)
+		}
+	}
+
+	return deleted, http.StatusOK
+}
+
+func (ds *Datastore) Exists(keys ...string) int {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	count := 0
+	for _, key := range keys {
+		// Repeated keys are counted once per occurrence
+		data, ok := ds.data[key]
+		if ok && data.isExpired() {
+			expired = append(expired, key)
+		} else if ok {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Expire sets the expiry of an existing key without changing its value and
+// returns 1 if applied or 0 if the key does not exist. A non-positive number
+// of seconds removes the key right away, and one too large for a
+// time.Duration is a bad request.
+func (ds *Datastore) Expire(key string, seconds int64) (int, int) {
+	ttl, ok := durationOf(seconds, time.Second)
+	if !ok {
+		return 0, http.StatusBadRequest
+	}
+	return ds.ExpireAt(key, time.Now().Add(ttl))
+}
+
+// ExpireAt is like Expire but takes an absolute deadline. A deadline that has
+// already passed removes the key right away.
+func (ds *Datastore) ExpireAt(key string, at time.Time) (int, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if !ok {
+		return 0, http.StatusNotFound
+	}
+
+	if !time.Now().Before(at) {
+		ds.remove(key)
+		return 1, http.StatusOK
+	}
+
+	data.expiry = at
+
+	return 1, http.StatusOK
+}
+
+// Persist clears the expiry of key and returns 1 if an expiry was removed,
+// or 0 if the key has no expiry or does not exist.
+func (ds *Datastore) Persist(key string) (int, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if !ok || data.expiry.IsZero() {
+		return 0, http.StatusOK
+	}
+
+	data.expiry = time.Time{}
+
+	return 1, http.StatusOK
+}
+
+// Type reports whether key holds a "string" or a "queue", or "none" when the
+// key is missing or expired.
+func (ds *Datastore) Type(key string) (string, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return "none", http.StatusNotFound
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return "none", http.StatusNotFound
+	}
+	if data.isQueued {
+		return "queue", http.StatusOK
+	}
+	if data.isHash {
+		return "hash", http.StatusOK
+	}
+	if data.isSet {
+		return "set", http.StatusOK
+	}
+	if data.isZSet {
+		return "zset", http.StatusOK
+	}
+	if data.isBitmap {
+		return "bitmap", http.StatusOK
+	}
+	if data.isHLL {
+		return "hll", http.StatusOK
+	}
+	if data.isStream {
+		return "stream", http.StatusOK
+	}
+
+	return "string", http.StatusOK
+}
+
+// Rename moves the entry at src, including its expiry and queue contents, to
+// dst, overwriting any existing dst entry. When nx is set an existing dst is
+// left untouched and StatusConflict is returned.
+func (ds *Datastore) Rename(src, dst string, nx bool) (string, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(src)
+	if !ok {
+		return "Key not exist", http.StatusNotFound
+	}
+	if _, ok := ds.lookup(dst); ok && nx {
+		return "Key already exists", http.StatusConflict
+	}
+
+	ds.remove(src)
+	ds.put(dst, data)
+	if len(data.reserved) > 0 {
+		ds.reservedKeys[dst] = struct{}{}
+	}
+	ds.serveWaiters(dst)
+	ds.servePushers(src)
+	ds.servePushers(dst)
+
+	return "Key is renamed successfully", http.StatusOK
+}
+
+// Copy duplicates the entry at src to dst. When nx is set an existing dst is
+// left untouched and StatusConflict is returned. Copying a key onto itself is
+// a bad request, as in Redis.
+//
+// Reservations stay with src: a copied queue holds only the values not
+// currently reserved, so no value is handed out twice, and QACK or QNACK of
+// a reservation made on src works on src alone.
+func (ds *Datastore) Copy(src, dst string, nx bool) (string, int) {
+	if src == dst {
+		return "source and destination are the same key", http.StatusBadRequest
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(src)
+	if !ok {
+		return "Key not exist", http.StatusNotFound
+	}
+	if _, ok := ds.lookup(dst); ok && nx {
+		return "Key already exists", http.StatusConflict
+	}
+
+	copied := data.clone()
+	if !ds.makeRoom(dst, func() int { return copied.approxSize(dst) }) {
+		return outOfMemoryMessage, http.StatusInsufficientStorage
+	}
+	ds.put(dst, copied)
+	ds.serveWaiters(dst)
+	ds.servePushers(dst)
+
+	return "Key is copied successfully", http.StatusOK
+}
+
+// Keys returns the sorted non-expired keys matching the glob pattern. At most
+// KeysLimit keys are returned and truncated reports whether more matched.
+func (ds *Datastore) Keys(pattern string) ([]string, bool, int) {
+	if _, err := matchGlob(pattern, ""); err != nil {
+		return nil, false, http.StatusBadRequest
+	}
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	keys := []string{}
+	truncated := false
+	for key, data := range ds.data {
+		if data.isExpired() {
+			continue
+		}
+		if matched, _ := matchGlob(pattern, key); !matched {
+			continue
+		}
+		if ds.opts.KeysLimit > 0 && len(keys) >= ds.opts.KeysLimit {
+			truncated = true
+			break
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys, truncated, http.StatusOK
+}
+
+// Scan returns up to count sorted non-expired keys matching pattern that sort
+// after the key encoded in cursor, along with the cursor for the next batch.
+// Iteration starts and ends with cursor "0". Because batches are ordered by
+// key rather than by map position, every key present for the whole scan is
+// returned even when other keys are written concurrently.
+func (ds *Datastore) Scan(cursor, pattern string, count int) (string, []string, int) {
+	after := ""
+	if cursor != "0" {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || cursor == "" {
+			return "", nil, http.StatusBadRequest
+		}
+		after = string(decoded)
+	}
+	if _, err := matchGlob(pattern, ""); err != nil {
+		return "", nil, http.StatusBadRequest
+	}
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	keys := []string{}
+	for key, data := range ds.data {
+		if (cursor != "0" && key <= after) || data.isExpired() {
+			continue
+		}
+		if matched, _ := matchGlob(pattern, key); matched {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	if len(keys) <= count {
+		return "0", keys, http.StatusOK
+	}
+	keys = keys[:count]
+
+	return base64.RawURLEncoding.EncodeToString([]byte(keys[count-1])), keys, http.StatusOK
+}
+
+// FlushAll removes every key and releases blocked BQPOP and BQPUSH callers
+// with a not-found result. They are taken off the waiting lists here, so a
+// push made before they get to run is not handed to them. It is refused
+// unless flushing has been allowed.
+func (ds *Datastore) FlushAll() (string, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if !ds.opts.AllowFlush {
+		return "FLUSHALL is disabled", http.StatusForbidden
+	}
+
+	ds.data = make(map[string]*Data)
+	ds.usedBytes = 0
+	ds.resized = make(map[string]*Data)
+	ds.waiters = make(map[string][]*queueWaiter)
+	ds.pushers = make(map[string][]*pushWaiter)
+	close(ds.flushed)
+	ds.flushed = make(chan struct{})
+
+	return "All keys are flushed", http.StatusOK
+}
+
+// DBSize returns the number of non-expired keys
+func (ds *Datastore) DBSize() int {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	count := 0
+	for _, data := range ds.data {
+		if !data.isExpired() {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Stats is a snapshot of datastore metrics served at /stats
+type Stats struct {
+	Keys              int   `json:"keys"`          // Non-expired keys
+	QueueKeys         int   `json:"queue_keys"`    // Non-expired keys holding a queue
+	HashKeys          int   `json:"hash_keys"`     // Non-expired keys holding a hash
+	SetKeys           int   `json:"set_keys"`      // Non-expired keys holding a set
+	ZSetKeys          int   `json:"zset_keys"`     // Non-expired keys holding a sorted set
+	BitmapKeys        int   `json:"bitmap_keys"`   // Non-expired keys holding a bitmap
+	HLLKeys           int   `json:"hll_keys"`      // Non-expired keys holding a HyperLogLog sketch
+	StreamKeys        int   `json:"stream_keys"`   // Non-expired keys holding a stream
+	KeysWithTTL       int   `json:"keys_with_ttl"` // Non-expired keys with an expiry
+	ExpiredKeys       int   `json:"expired_keys"`  // Expired keys not yet removed
+	ApproxMemoryBytes int   `json:"approx_memory_bytes"`
+	EvictedKeys       int64 `json:"evicted_keys"` // Keys evicted to stay within limits
+}
+
+func (ds *Datastore) Stats() Stats {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	stats := Stats{EvictedKeys: ds.evictions}
+	for key, data := range ds.data {
+		stats.ApproxMemoryBytes += data.approxSize(key)
+		if data.isExpired() {
+			stats.ExpiredKeys++
+			continue
+		}
+		stats.Keys++
+		if data.isQueued {
+			stats.QueueKeys++
+		}
+		if data.isHash {
+			stats.HashKeys++
+		}
+		if data.isSet {
+			stats.SetKeys++
+		}
+		if data.isZSet {
+			stats.ZSetKeys++
+		}
+		if data.isBitmap {
+			stats.BitmapKeys++
+		}
+		if data.isHLL {
+			stats.HLLKeys++
+		}
+		if data.isStream {
+			stats.StreamKeys++
+		}
+		if !data.expiry.IsZero() {
+			stats.KeysWithTTL++
+		}
+	}
+
+	return stats
+}
+
+// Healthy reports whether the datastore is open and its read lock can be
+// taken within timeout. The lock is tried every millisecond rather than
+// waited on, so a probe that times out leaves nothing behind still waiting.
+func (ds *Datastore) Healthy(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		select {
+		case <-ds.done:
+			return false
+		default:
+		}
+
+		if ds.mu.TryRLock() {
+			ds.mu.RUnlock()
+			return true
+		}
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// DeleteExpired removes every entry whose expiry has passed and returns how
+// many were removed. Entries without an expiry, including queues, are kept.
+func (ds *Datastore) DeleteExpired() int {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	removed := 0
+	for key, data := range ds.data {
+		if data.isExpired() {
+			ds.remove(key)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// sweepExpired checks up to sample entries, in Go's randomized map order, and
+// removes the expired ones. The lock is held only for this one short burst.
+func (ds *Datastore) sweepExpired(sample int) (checked, removed int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	for key, data := range ds.data {
+		if checked == sample {
+			break
+		}
+		checked++
+		if data.isExpired() {
+			ds.remove(key)
+			removed++
+		}
+	}
+
+	return checked, removed
+}
+
+// StartExpiryReaper removes expired keys in the background every interval so
+// keys that are never read again do not stay in memory. Each cycle first
+// returns lapsed QRESERVE reservations to their queues, then samples
+// batchSize keys at a time and keeps sampling while more than a quarter of a
+// sample was expired; a batchSize of 0 or less sweeps the whole map at once.
+// The reaper stops when the datastore is closed.
+func (ds *Datastore) StartExpiryReaper(interval time.Duration, batchSize int) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ds.done:
+				return
+			case <-ticker.C:
+			}
+
+			ds.RequeueLapsed()
+			if batchSize <= 0 {
+				ds.DeleteExpired()
+				continue
+			}
+			for {
+				checked, removed := ds.sweepExpired(batchSize)
+				if checked < batchSize || removed*4 <= checked {
+					break
+				}
+				select {
+				case <-ds.done:
+					return
+				default:
+				}
+			}
+		}
+	}()
+}
+
+// matchGlob reports whether name matches pattern. It supports the same syntax
+// as path.Match ('*', '?', '[...]' classes and '\\' escapes) but treats '/'
+// as an ordinary character, since keys are not paths. Like path.Match it
+// splits the pattern at stars and only ever goes back to the last one, so
+// matching takes time linear in the name for each chunk of the pattern
+// rather than exponential in the number of stars.
+func matchGlob(pattern, name string) (bool, error) {
+Pattern:
+	for len(pattern) > 0 {
+		var star bool
+		var chunk string
+		star, chunk, pattern = scanGlobChunk(pattern)
+		if star && chunk == "" {
+			return true, nil // A trailing star matches the rest of name
+		}
+
+		// The last chunk has to use up the rest of name
+		t, ok, err := matchGlobChunk(chunk, name)
+		if ok && (len(t) == 0 || len(pattern) > 0) {
+			name = t
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if star {
+			for i := 0; i < len(name); i++ {
+				t, ok, err := matchGlobChunk(chunk, name[i+1:])
+				if ok {
+					if len(pattern) == 0 && len(t) > 0 {
+						continue
+					}
+					name = t
+					continue Pattern
+				}
+				if err != nil {
+					return false, err
+				}
+			}
+		}
+
+		// Report a malformed pattern even when it fails to match early
+		for len(pattern) > 0 {
+			_, chunk, pattern = scanGlobChunk(pattern)
+			if _, _, err := matchGlobChunk(chunk, ""); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+	return len(name) == 0, nil
+}
+
+// scanGlobChunk skips the stars at the start of pattern, reporting whether
+// there were any, and splits off the chunk up to the next star outside a
+// class
+func scanGlobChunk(pattern string) (star bool, chunk, rest string) {
+	for len(pattern) > 0 && pattern[0] == '*' {
+		pattern = pattern[1:]
+		star = true
+	}
+	inClass := false
+	i := 0
+scan:
+	for ; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			if !inClass && i+1 < len(pattern) {
+				i++
+			}
+		case '[':
+			inClass = true
+		case ']':
+			inClass = false
+		case '*':
+			if !inClass {
+				break scan
+			}
+		}
+	}
+	return star, pattern[:i], pattern[i:]
+}
+
+// matchGlobChunk matches a star-free chunk against the start of s and
+// returns the rest of s. The whole chunk is checked for syntax even once it
+// has failed to match.
+func matchGlobChunk(chunk, s string) (rest string, ok bool, err error) {
+	failed := false
+	for len(chunk) > 0 {
+		if !failed && len(s) == 0 {
+			failed = true
+		}
+		switch chunk[0] {
+		case '[':
+			end := strings.IndexByte(chunk[1:], ']')
+			if end < 1 {
+				return "", false, path.ErrBadPattern
+			}
+			class := chunk[1 : end+1]
+			chunk = chunk[end+2:]
+			if !failed {
+				if !matchGlobClass(class, s[0]) {
+					failed = true
+				}
+				s = s[1:]
+			}
+			continue
+		case '?':
+			if !failed {
+				s = s[1:]
+			}
+			chunk = chunk[1:]
+			continue
+		case '\\':
+			if len(chunk) < 2 {
+				return "", false, path.ErrBadPattern
+			}
+			chunk = chunk[1:]
+		}
+		if !failed {
+			if chunk[0] != s[0] {
+				failed = true
+			}
+			s = s[1:]
+		}
+		chunk = chunk[1:]
+	}
+	if failed {
+		return "", false, nil
+	}
+	return s, true, nil
+}
+
+// matchGlobClass reports whether c is matched by the body of a '[...]'
+// class, which may start with '^' or '!' to negate it and hold a-z ranges
+func matchGlobClass(class string, c byte) bool {
+	negate := class[0] == '^' || class[0] == '!'
+	if negate {
+		class = class[1:]
+	}
+	found := false
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			if class[i] <= c && c <= class[i+2] {
+				found = true
+			}
+			i += 2
+		} else if class[i] == c {
+			found = true
+		}
+	}
+	return found != negate
+}
+
+// parseExpiry turns an EX<seconds>, PX<milliseconds> or EXAT<timestamp> token
+// into an absolute expiry time. EX and PX need a positive number, EXAT a
+// non-negative one.
+func parseExpiry(arg string) (time.Time, error) {
+	var option, number string
+	var unit time.Duration
+	switch {
+	case strings.HasPrefix(arg, "EXAT"):
+		option, number = "EXAT", arg[4:]
+	case strings.HasPrefix(arg, "EX"):
+		option, number, unit = "EX", arg[2:], time.Second
+	case strings.HasPrefix(arg, "PX"):
+		option, number, unit = "PX", arg[2:], time.Millisecond
+	default:
+		return time.Time{}, fmt.Errorf("invalid expiry option %q, expected EX<seconds>, PX<milliseconds> or EXAT<timestamp>", arg)
+	}
+
+	if number == "" {
+		return time.Time{}, fmt.Errorf("missing number after %s", option)
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s value %q is not an integer", option, number)
+	}
+
+	if option == "EXAT" {
+		if n < 0 {
+			return time.Time{}, fmt.Errorf("EXAT value must not be negative")
+		}
+		at, ok := unixTimestamp(n)
+		if !ok {
+			return time.Time{}, fmt.Errorf("EXAT value is too far in the future")
+		}
+		return at, nil
+	}
+	if n <= 0 {
+		return time.Time{}, fmt.Errorf("%s value must be positive", option)
+	}
+	ttl, ok := durationOf(n, unit)
+	if !ok {
+		return time.Time{}, fmt.Errorf("%s value is too large", option)
+	}
+
+	return time.Now().Add(ttl), nil
+}
+
+// durationOf returns n units as a time.Duration, or false if that does not
+// fit in one
+func durationOf(n int64, unit time.Duration) (time.Duration, bool) {
+	if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// parseUnixTimestamp parses a non-negative number of seconds since the epoch
+func parseUnixTimestamp(s string) (time.Time, bool) {
+	seconds, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, false
+	}
+	return unixTimestamp(seconds)
+}
+
+// unixTimestamp returns the time seconds after the epoch, or false if it is
+// too far ahead for the time left until it to fit in a time.Duration, which
+// TTL could then not report
+func unixTimestamp(seconds int64) (time.Time, bool) {
+	if seconds-time.Now().Unix() >= math.MaxInt64/int64(time.Second) {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0), true
+}
+
+// setOptions holds the optional tokens that may follow SET key value
+type setOptions struct {
+	expiry      time.Time
+	conditional string // "NX", "XX" or empty
+	keepTTL     bool
+	force       bool // Allow replacing a key of another type with a string
+}
+
+// parseSetOptions parses SET options given in any order. Expiries can be
+// written attached (EX10) or as two tokens (EX 10). Duplicate or conflicting
+// options are rejected.
+func parseSetOptions(tokens []string) (setOptions, error) {
+	var opts setOptions
+	hasExpiry := false
+
+	for i := 0; i < len(tokens); i++ {
+		token := strings.ToUpper(tokens[i])
+		switch token {
+		case "NX", "XX":
+			if opts.conditional != "" {
+				return opts, fmt.Errorf("only one of NX and XX may be given")
+			}
+			opts.conditional = token
+			continue
+		case "FORCE":
+			if opts.force {
+				return opts, fmt.Errorf("FORCE given more than once")
+			}
+			opts.force = true
+			continue
+		case "KEEPTTL":
+			if opts.keepTTL {
+				return opts, fmt.Errorf("KEEPTTL given more than once")
+			}
+			opts.keepTTL = true
+			continue
+		case "EX", "PX", "EXAT":
+			if i+1 == len(tokens) {
+				return opts, fmt.Errorf("missing number after %s", token)
+			}
+			// Joined only once known to be a number, or EX AT5 would read
+			// as EXAT5
+			i++
+			if _, err := strconv.ParseInt(tokens[i], 10, 64); err != nil {
+				return opts, fmt.Errorf("%s value %q is not an integer", token, tokens[i])
+			}
+			token += tokens[i]
+		default:
+			if !strings.HasPrefix(token, "EX") && !strings.HasPrefix(token, "PX") {
+				return opts, fmt.Errorf("unknown SET option %q", tokens[i])
+			}
+			// Only the option name is case-insensitive, so errors quote the
+			// number as given
+			name := len("EX")
+			if strings.HasPrefix(token, "EXAT") {
+				name = len("EXAT")
+			}
+			token = token[:name] + tokens[i][name:]
+		}
+
+		expiry, err := parseExpiry(token)
+		if err != nil {
+			return opts, err
+		}
+		if hasExpiry {
+			return opts, fmt.Errorf("only one of EX, EXAT and PX may be given")
+		}
+		opts.expiry = expiry
+		hasExpiry = true
+	}
+
+	if hasExpiry && opts.keepTTL {
+		return opts, fmt.Errorf("KEEPTTL cannot be combined with an expiry")
+	}
+
+	return opts, nil
+}
+
+func (ds *Datastore) ValidateSetInput(args []string) bool {
+	if len(args) < 2 {
+		return false
+	}
+
+	_, err := parseSetOptions(args[2:])
+	return err == nil
+}
+
+// addWaiter puts w at the end of the waiter list of each of its keys. The
+// caller must hold the write lock.
+func (ds *Datastore) addWaiter(w *queueWaiter) {
+	for _, key := range w.keys {
+		ds.waiters[key] = append(ds.waiters[key], w)
+	}
+}
+
+// removeWaiter takes w off the waiter list of each of its keys. The caller
+// must hold the write lock.
+func (ds *Datastore) removeWaiter(w *queueWaiter) {
+	for _, key := range w.keys {
+		waiters := ds.waiters[key]
+		for i, other := range waiters {
+			if other == w {
+				waiters = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(ds.waiters, key)
+		} else {
+			ds.waiters[key] = waiters
+		}
+	}
+}
+
+// serveWaiters hands values from the queue or sorted set at key to the
+// callers blocked on it, longest waiting first, until either runs out. Only
+// waiters for that type of key are served. Each served waiter is removed
+// from all of its keys. The caller must hold the write lock.
+func (ds *Datastore) serveWaiters(key string) {
+	data, ok := ds.data[key]
+	if !ok {
+		return
+	}
+	ds.changed(key, data)
+	if data.isZSet {
+		ds.serveZPopWaiters(key, data)
+		return
+	}
+	if !data.isQueued {
+		return
+	}
+
+	for data.hasVisible() {
+		w := ds.nextWaiter(key, false)
+		if w == nil {
+			break
+		}
+		ds.removeWaiter(w)
+
+		if w.moveTo != "" {
+			w.value, w.status = ds.moveLocked(data, key, w.moveTo, w.back)
+		} else {
+			w.value, w.status = data.pop(1, w.back)[0], http.StatusOK
+		}
+		w.key, w.served = key, true
+		w.wake <- struct{}{}
+	}
+}
+
+// nextWaiter returns the longest waiting caller blocked on key for a queue,
+// or for a sorted set when zpop is set, or nil if there is none. The caller
+// must hold the write lock.
+func (ds *Datastore) nextWaiter(key string, zpop bool) *queueWaiter {
+	for _, w := range ds.waiters[key] {
+		if w.zpop == zpop {
+			return w
+		}
+	}
+	return nil
+}
+
+// QMove pops a value from the front of the queue at src, or the back when
+// back is set, and pushes it onto the end of the queue at dst in one step, so
+// the value is always in exactly one of the two queues. dst is created if
+// missing, and src and dst may be the same queue to rotate it. It returns the
+// moved value.
+func (ds *Datastore) QMove(src, dst string, back bool) (string, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(src)
+	if ok && !data.isQueued {
+		return wrongTypeMessage, http.StatusConflict
+	}
+	if data, ok := ds.lookup(dst); ok && !data.isQueued {
+		return wrongTypeMessage, http.StatusConflict
+	}
+	if !ok || !data.hasVisible() {
+		return "Q is empty so nothing can be popped!!", http.StatusBadRequest
+	}
+
+	return ds.moveLocked(data, src, dst, back)
+}
+
+// BQMove is the blocking form of QMove. If the queue at src is empty it
+// waits for a value like BQPop, with the same timeout rules, and moves it as
+// soon as it is pushed.
+func (ds *Datastore) BQMove(ctx context.Context, src, dst string, timeoutSeconds float64, back bool) (string, int) {
+	expired, stop := ds.blockTimer(timeoutSeconds)
+	defer stop()
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(src)
+	if ok && !data.isQueued {
+		return wrongTypeMessage, http.StatusConflict
+	}
+	if data, ok := ds.lookup(dst); ok && !data.isQueued {
+		return wrongTypeMessage, http.StatusConflict
+	}
+	if ok && data.hasVisible() {
+		return ds.moveLocked(data, src, dst, back)
+	}
+
+	w := &queueWaiter{keys: []string{src}, back: back, moveTo: dst, wake: make(chan struct{}, 1)}
+	ds.addWaiter(w)
+
+	status := ds.block(ctx, w.wake, expired)
+
+	if w.served {
+		return w.value, w.status
+	}
+	ds.removeWaiter(w)
+
+	return "", status
+}
+
+// moveLocked pops one value from data, the queue at src, and pushes it onto
+// dst. If dst refuses it, for being full or of the wrong type, the value is
+// put back where it came from and dst's error is returned. The caller must
+// hold the write lock.
+func (ds *Datastore) moveLocked(data *Data, src, dst string, back bool) (string, int) {
+	item := data.popItems(1, back)[0]
+
+	if result, status := ds.pushItemsLocked(dst, false, time.Time{}, []queueItem{item}); status != http.StatusOK {
+		if back {
+			data.queue = append(data.queue, item)
+		} else {
+			data.queue = append([]queueItem{item}, data.queue...)
+		}
+		data.pops--
+		return result, status
+	}
+	if src != dst {
+		ds.servePushers(src)
+	}
+
+	return item.value, http.StatusOK
+}
+
+// blockTimer returns a channel that fires once a blocking command's timeout
+// has passed, along with a func to release the timer. The float is scaled
+// before conversion so fractional seconds are kept. A zero timeout gives a
+// nil channel, which never fires, and either way the wait is capped at
+// Options.MaxBlockTimeout when that is set.
+func (ds *Datastore) blockTimer(timeoutSeconds float64) (<-chan time.Time, func()) {
+	timeout := time.Duration(timeoutSeconds * float64(time.Second))
+	if timeoutSeconds > 0 && timeout == 0 {
+		timeout = 1 // Too small for a Duration, but still not a wait forever
+	}
+	if max := ds.opts.MaxBlockTimeout; max > 0 && (timeout == 0 || timeout > max) {
+		timeout = max
+	}
+	if timeout == 0 {
+		return nil, func() {}
+	}
+
+	timer := time.NewTimer(timeout)
+	return timer.C, func() { timer.Stop() }
+}
+
+// block releases the write lock, which the caller must hold, until wake is
+// signalled or the wait ends early, then takes the lock again. It returns
+// StatusOK when woken, otherwise the status the blocking command should fail
+// with.
+func (ds *Datastore) block(ctx context.Context, wake <-chan struct{}, expired <-chan time.Time) int {
+	flushed := ds.flushed
+
+	ds.mu.Unlock()
+	defer ds.mu.Lock()
+
+	select {
+	case <-wake:
+		return http.StatusOK
+	case <-expired:
+		return http.StatusNotFound
+	case <-ds.done:
+		return http.StatusServiceUnavailable
+	case <-flushed:
+		return http.StatusNotFound
+	case <-ctx.Done():
+		return http.StatusRequestTimeout
+	}
+}
+
+// BQPush pushes values onto the queue at key like QPush, but when the queue's
+// capacity would be exceeded it waits up to timeoutSeconds for pops to make
+// room for all of them. Values are never partly pushed. Waiting pushers are
+// served in the order they started waiting, and the timeout follows the same
+// rules as BQPop. More values than the capacity could never fit, however
+// much is popped, so they are refused straight away.
+func (ds *Datastore) BQPush(ctx context.Context, key string, timeoutSeconds float64, values ...string) (string, int) {
+	expired, stop := ds.blockTimer(timeoutSeconds)
+	defer stop()
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if data, ok := ds.lookup(key); ok && data.neverFits(len(values)) {
+		return queueFullMessage, http.StatusTooManyRequests
+	}
+	if len(ds.pushers[key]) == 0 {
+		result, status := ds.pushLocked(key, false, time.Time{}, values)
+		if status != http.StatusTooManyRequests {
+			return result, status
+		}
+	}
+
+	w := &pushWaiter{key: key, values: values, wake: make(chan struct{}, 1)}
+	ds.pushers[key] = append(ds.pushers[key], w)
+	ds.servePushers(key) // Room may have appeared without a pop, e.g. by expiry
+
+	status := ds.block(ctx, w.wake, expired)
+
+	// A push made just as the wait ended still counts
+	if w.served {
+		return w.result, w.status
+	}
+	ds.removePusher(w)
+
+	return "", status
+}
+
+// servePushers pushes on behalf of the callers blocked in BQPush on key for
+// as long as the one that has waited longest fits. A caller whose values can
+// no longer ever fit, because QCAP lowered the capacity, is failed instead of
+// holding up those behind it. The caller must hold the write lock.
+func (ds *Datastore) servePushers(key string) {
+	for len(ds.pushers[key]) > 0 {
+		w := ds.pushers[key][0]
+		result, status := ds.pushLocked(key, false, time.Time{}, w.values)
+		if status == http.StatusTooManyRequests && !ds.data[key].neverFits(len(w.values)) {
+			return
+		}
+		ds.removePusher(w)
+
+		w.result, w.status, w.served = result, status, true
+		w.wake <- struct{}{}
+	}
+}
+
+// neverFits reports whether n values are more than the queue could ever hold
+// at once, so pushing them can only be refused
+func (d *Data) neverFits(n int) bool {
+	return d.isQueued && d.capacity > 0 && !d.trimToCap && n > d.capacity
+}
+
+// removePusher takes w off its key's list of blocked pushers. The caller must
+// hold the write lock.
+func (ds *Datastore) removePusher(w *pushWaiter) {
+	pushers := ds.pushers[w.key]
+	for i, other := range pushers {
+		if other == w {
+			pushers = append(pushers[:i], pushers[i+1:]...)
+			break
+		}
+	}
+	if len(pushers) == 0 {
+		delete(ds.pushers, w.key)
+	} else {
+		ds.pushers[w.key] = pushers
+	}
+}
+
+// ValidateBQPopInput checks for one or more keys followed by a valid timeout
+func (ds *Datastore) ValidateBQPopInput(args []string) bool {
+	if len(args) < 2 {
+		return false
+	}
+
+	_, ok := parseBlockTimeout(args[len(args)-1])
+	return ok
+}
+
+// parseBlockTimeout parses the timeout of a blocking command, in seconds. It
+// must be non-negative and small enough to fit in a time.Duration.
+func parseBlockTimeout(s string) (float64, bool) {
+	timeout, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(timeout) || timeout < 0 || timeout >= math.MaxInt64/float64(time.Second) {
+		return 0, false
+	}
+	return timeout, true
+}
+
+// isQueueExpiryToken reports whether a QPUSH argument is an EX<seconds> or
+// PX<milliseconds> expiry rather than the first value. Only the exact form
+// counts, so values such as "EXPORT" or "ex10" are pushed as they are.
+func isQueueExpiryToken(arg string) bool {
+	if !strings.HasPrefix(arg, "EX") && !strings.HasPrefix(arg, "PX") {
+		return false
+	}
+	number := arg[2:]
+	if number == "" {
+		return false
+	}
+	for _, r := range number {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseQueueDelay reports whether the remaining QPUSH arguments start with a
+// DELAY option, and if so parses its number of seconds. Only the exact upper
+// case form counts, so a value named "delay" can still be pushed. Once DELAY
+// comes first, ok is false unless a valid number and at least one value
+// follow, so a malformed delay is refused rather than pushed as values.
+func parseQueueDelay(args []string) (seconds float64, delayed, ok bool) {
+	if len(args) == 0 || args[0] != "DELAY" {
+		return 0, false, true
+	}
+	if len(args) < 3 {
+		return 0, true, false
+	}
+	seconds, ok = parseBlockTimeout(args[1])
+	return seconds, true, ok
+}
+
+// parsePopDirection strips an optional trailing FRONT or BACK from the
+// arguments of QPOP and BQPOP. Pops come from the front, oldest value first,
+// unless BACK is given. A lone argument is always a key, so a queue may be
+// named FRONT or BACK.
+func parsePopDirection(args []string) ([]string, bool) {
+	if len(args) < 2 {
+		return args, false
+	}
+
+	switch strings.ToUpper(args[len(args)-1]) {
+	case "FRONT":
+		return args[:len(args)-1], false
+	case "BACK":
+		return args[:len(args)-1], true
+	}
+
+	return args, false
+}
+
+// ParseCommand splits a raw command on runs of whitespace, so extra spaces,
+// tabs and leading or trailing whitespace are ignored. Single or double
+// quotes group text, spaces included, into one argument, and inside quotes a
+// backslash escapes the next character. An empty command gives an empty verb.
+func (ds *Datastore) ParseCommand(rawCommand string) (string, []string, error) {
+	args, err := tokenizeCommand(rawCommand)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(args) == 0 {
+		return "", nil, nil
+	}
+	command := strings.ToUpper(args[0])
+	args = args[1:]
+
+	return command, args, nil
+}
+
+// tokenizeCommand does the splitting for ParseCommand. A quote opens quoted
+// text only at the start of an argument, so the apostrophe in don't is kept
+// as is. Text straight after the closing quote joins the same argument.
+func tokenizeCommand(rawCommand string) ([]string, error) {
+	var args []string
+	var token strings.Builder
+	inToken := false // Distinguishes an empty quoted argument from no argument
+	var quote rune
+
+	runes := []rune(rawCommand)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0 && r == '\\':
+			if i+1 == len(runes) {
+				return nil, errors.New("unbalanced quotes in command")
+			}
+			i++
+			token.WriteRune(runes[i])
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			token.WriteRune(r)
+		case (r == '"' || r == '\'') && !inToken:
+			quote = r
+			inToken = true
+		case unicode.IsSpace(r):
+			if inToken {
+				args = append(args, token.String())
+				token.Reset()
+				inToken = false
+			}
+		default:
+			token.WriteRune(r)
+			inToken = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.New("unbalanced quotes in command")
+	}
+	if inToken {
+		args = append(args, token.String())
+	}
+
+	return args, nil
+}
+
+// incrResult builds the response body for the INCR family of commands
+func incrResult(value int64, status int) (interface{}, int) {
+	switch status {
+	case http.StatusOK:
+		return map[string]int64{"value": value}, status
+	case http.StatusConflict:
+		return map[string]string{"error": wrongTypeMessage}, status
+	default:
+		return map[string]string{"error": "value is not an integer or out of range"}, status
+	}
+}
+
+// HandleCommand parses and runs a raw command. ctx bounds blocking commands
+// such as BQPOP.
+func (ds *Datastore) HandleCommand(ctx context.Context, rawCommand string) (interface{}, int) {
+	command, args, err := ds.ParseCommand(rawCommand)
+	if err != nil {
+		return err.Error(), http.StatusBadRequest
+	}
+
+	return ds.ExecuteCommand(ctx, command, args)
+}
+
+// PipelineResult is the outcome of one command sent to /pipeline. Failed
+// commands carry the same error body /command/ would have returned.
+type PipelineResult struct {
+	Status int         `json:"status"`
+	Result interface{} `json:"result"`
+}
+
+// Pipeline runs commands in order through HandleCommand and returns their
+// results in the same order. Each command takes the lock on its own, exactly
+// as a separate request would, so commands from other clients may run in
+// between. A failed command does not stop the ones after it.
+func (ds *Datastore) Pipeline(ctx context.Context, commands []string) []PipelineResult {
+	results := make([]PipelineResult, len(commands))
+	for i, rawCommand := range commands {
+		result, status := ds.HandleCommand(ctx, rawCommand)
+		if status != http.StatusOK {
+			result = errorResponse(result, status)
+		}
+		results[i] = PipelineResult{Status: status, Result: result}
+	}
+
+	return results
+}
+
+// ExecuteCommand runs an already tokenized command and counts it in the
+// metrics. command must be upper case.
+func (ds *Datastore) ExecuteCommand(ctx context.Context, command string, args []string) (interface{}, int) {
+	result, status := ds.executeCommand(ctx, command, args)
+	ds.metrics.observeCommand(command, result, status)
+
+	return result, status
+}
+
+func (ds *Datastore) executeCommand(ctx context.Context, command string, args []string) (interface{}, int) {
+	switch command {
+	case "SET":
+		if len(args) < 2 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		opts, err := parseSetOptions(args[2:])
+		if err != nil {
+			return map[string]string{"error": err.Error()}, http.StatusBadRequest
+		}
+		return ds.Set(args[0], args[1], opts)
+
+	case "SETNX":
+		if len(args) != 2 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		// Any existing key, whatever its type, means the key was not set
+		result, status := ds.Set(args[0], args[1], setOptions{conditional: "NX"})
+		switch status {
+		case http.StatusOK:
+			return map[string]int{"set": 1}, status
+		case http.StatusConflict:
+			return map[string]int{"set": 0}, http.StatusOK
+		}
+		return result, status
+
+	case "SETEX":
+		if len(args) != 3 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		seconds, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return map[string]string{"error": fmt.Sprintf("SETEX seconds %q is not an integer", args[1])}, http.StatusBadRequest
+		}
+		if seconds <= 0 {
+			return map[string]string{"error": "SETEX seconds must be positive"}, http.StatusBadRequest
+		}
+		ttl, ok := durationOf(seconds, time.Second)
+		if !ok {
+			return map[string]string{"error": "SETEX seconds value is too large"}, http.StatusBadRequest
+		}
+		return ds.Set(args[0], args[2], setOptions{expiry: time.Now().Add(ttl)})
+
+	case "GET":
+		if len(args) != 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		key := args[0]
+		value, status := ds.Get(key)
+		if status == http.StatusOK {
+			return map[string]string{"value": value}, status
+		}
+		return map[string]string{"error": value}, status
+
+	case "MSET":
+		return ds.MSet(args...)
+
+	case "MGET":
+		if len(args) < 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		values, status := ds.MGet(args...)
+		return map[string]interface{}{"values": values}, status
+
+	case "TYPE":
+		if len(args) != 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		keyType, status := ds.Type(args[0])
+		return map[string]string{"type": keyType}, status
+
+	case "RENAME", "RENAMENX":
+		if len(args) != 2 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		return ds.Rename(args[0], args[1], command == "RENAMENX")
+
+	case "COPY":
+		if len(args) != 2 && (len(args) != 3 || strings.ToUpper(args[2]) != "NX") {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		return ds.Copy(args[0], args[1], len(args) == 3)
+
+	case "KEYS":
+		if len(args) != 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		keys, truncated, status := ds.Keys(args[0])
+		if status != http.StatusOK {
+			return "Invalid Command", status
+		}
+		return map[string]interface{}{"keys": keys, "truncated": truncated}, status
+
+	case "SCAN":
+		if len(args) < 1 || len(args)%2 != 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		pattern := "*"
+		count := DefaultScanCount
+		for i := 1; i < len(args); i += 2 {
+			switch strings.ToUpper(args[i]) {
+			case "MATCH":
+				pattern = args[i+1]
+			case "COUNT":
+				n, err := strconv.Atoi(args[i+1])
+				if err != nil || n < 1 || n > MaxScanCount {
+					return "Invalid Command", http.StatusBadRequest
+				}
+				count = n
+			default:
+				return "Invalid Command", http.StatusBadRequest
+			}
+		}
+		cursor, keys, status := ds.Scan(args[0], pattern, count)
+		if status != http.StatusOK {
+			return "Invalid Command", status
+		}
+		return map[string]interface{}{"cursor": cursor, "keys": keys}, status
+
+	case "FLUSHALL":
+		if len(args) != 0 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		return ds.FlushAll()
+
+	case "INFO":
+		if len(args) != 0 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		return ds.Stats(), http.StatusOK
+
+	case "DBSIZE":
+		if len(args) != 0 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		return map[string]int{"keys": ds.DBSize()}, http.StatusOK
+
+	case "GETSET":
+		if len(args) != 2 && (len(args) != 3 || args[2] != "KEEPTTL") {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		old, status := ds.GetSet(args[0], args[1], len(args) == 3)
+		if status == http.StatusOK {
+			return map[string]string{"old": old}, status
+		}
+		return old, status
+
+	case "GETDEL":
+		if len(args) != 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		value, status := ds.GetDel(args[0])
+		if status == http.StatusOK {
+			return map[string]string{"value": value}, status
+		}
+		return value, status
+
+	case "QPUSH":
+		if len(args) < 2 {
+			return nil, http.StatusBadRequest
+		}
+		key := args[0]
+		values := args[1:]
+		var expiry time.Time
+		if isQueueExpiryToken(values[0]) {
+			if len(values) < 2 {
+				return nil, http.StatusBadRequest
+			}
+			var err error
+			if expiry, err = parseExpiry(values[0]); err != nil {
+				return err.Error(), http.StatusBadRequest
+			}
+			values = values[1:]
+		}
+		var delay time.Duration
+		seconds, delayed, ok := parseQueueDelay(values)
+		if !ok {
+			return "DELAY needs a non-negative number of seconds followed by values", http.StatusBadRequest
+		}
+		if delayed {
+			delay = time.Duration(seconds * float64(time.Second))
+			values = values[2:]
+		}
+		return ds.QPushDelayed(key, expiry, delay, values...)
+
+	case "QPUSHFRONT":
+		if len(args) < 2 {
+			return nil, http.StatusBadRequest
+		}
+		return ds.QPushFront(args[0], args[1:]...)
+
+	case "BQPUSH":
+		if len(args) < 3 {
+			return nil, http.StatusBadRequest
+		}
+		timeoutSeconds, ok := parseBlockTimeout(args[1])
+		if !ok {
+			return nil, http.StatusBadRequest
+		}
+		result, status := ds.BQPush(ctx, args[0], timeoutSeconds, args[2:]...)
+		if status != http.StatusOK && result == "" {
+			return nil, status
+		}
+		return result, status
+
+	case "QMOVE":
+		args, back := parsePopDirection(args)
+		if len(args) != 2 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		value, status := ds.QMove(args[0], args[1], back)
+		if status == http.StatusOK {
+			return map[string]string{"value": value}, status
+		}
+		return map[string]string{"error": value}, status
+
+	case "BQMOVE":
+		args, back := parsePopDirection(args)
+		if len(args) != 3 {
+			return nil, http.StatusBadRequest
+		}
+		timeoutSeconds, ok := parseBlockTimeout(args[2])
+		if !ok {
+			return nil, http.StatusBadRequest
+		}
+		value, status := ds.BQMove(ctx, args[0], args[1], timeoutSeconds, back)
+		if status == http.StatusOK {
+			return map[string]string{"value": value}, status
+		}
+		if value == "" {
+			return nil, status
+		}
+		return map[string]string{"error": value}, status
+
+	case "QPOP":
+		args, back := parsePopDirection(args)
+		if len(args) == 2 {
+			count, err := strconv.Atoi(args[1])
+			if err != nil || count < 1 {
+				return nil, http.StatusBadRequest
+			}
+			values, status := ds.QPopN(args[0], count, back)
+			if status == http.StatusOK {
+				return map[string][]string{"values": values}, status
+			}
+			return map[string]string{"error": values[0]}, status
+		}
+		if len(args) != 1 {
+			return nil, http.StatusBadRequest
+		}
+		key := args[0]
+		value, status := ds.QPop(key, back)
+		if status == http.StatusOK {
+			return map[string]string{"value": value}, status
+		}
+		return map[string]string{"error": value}, status
+
+	case "QPOPFRONT", "QPOPBACK":
+		if len(args) != 1 {
+			return nil, http.StatusBadRequest
+		}
+		pop := ds.QPopFront
+		if command == "QPOPBACK" {
+			pop = ds.QPopBack
+		}
+		value, status := pop(args[0])
+		if status == http.StatusOK {
+			return map[string]string{"value": value}, status
+		}
+		return map[string]string{"error": value}, status
+
+	case "QPEEK":
+		if len(args) == 2 {
+			count, err := strconv.Atoi(args[1])
+			if err != nil || count < 0 {
+				return "Invalid Command", http.StatusBadRequest
+			}
+			values, status := ds.QPeekN(args[0], count)
+			if status == http.StatusOK {
+				return map[string][]string{"values": values}, status
+			}
+			return values[0], status
+		}
+		if len(args) != 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		value, status := ds.QPeek(args[0])
+		if status == http.StatusOK {
+			return map[string]string{"value": value}, status
+		}
+		return value, status
+
+	case "QRANGE":
+		if len(args) != 3 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		start, err1 := strconv.Atoi(args[1])
+		stop, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		values, status := ds.QRange(args[0], start, stop)
+		if status == http.StatusOK {
+			// "items" is the documented key; "values" matches QPOP and QPEEK
+			// and is kept for clients already reading it
+			return map[string][]string{"items": values, "values": values}, status
+		}
+		return wrongTypeMessage, status
+
+	case "QTRIM":
+		if len(args) != 3 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		start, err1 := strconv.Atoi(args[1])
+		stop, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		return ds.QTrim(args[0], start, stop)
+
+	case "QREM":
+		if len(args) != 3 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		count, err := strconv.Atoi(args[1])
+		if err != nil {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		removed, status := ds.QRem(args[0], count, args[2])
+		if status == http.StatusOK {
+			return map[string]int{"removed": removed}, status
+		}
+		return wrongTypeMessage, status
+
+	case "QCAP":
+		if len(args) == 1 {
+			capacity, status := ds.QCapacity(args[0])
+			if status == http.StatusOK {
+				return map[string]int{"capacity": capacity}, status
+			}
+			return wrongTypeMessage, status
+		}
+		if len(args) != 2 && len(args) != 3 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		capacity, err := strconv.Atoi(args[1])
+		if err != nil || capacity < 0 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		trim := false
+		if len(args) == 3 {
+			switch strings.ToUpper(args[2]) {
+			case "REJECT":
+			case "TRIM":
+				trim = true
+			default:
+				return "Invalid Command", http.StatusBadRequest
+			}
+		}
+		return ds.QCap(args[0], capacity, trim)
+
+	case "QRESERVE":
+		if len(args) != 2 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		seconds, err := strconv.ParseInt(args[1], 10, 64)
+		timeout, ok := durationOf(seconds, time.Second)
+		if err != nil || seconds <= 0 || !ok {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		id, value, deliveries, status := ds.QReserve(args[0], timeout)
+		if status == http.StatusOK {
+			return map[string]interface{}{"id": id, "value": value, "deliveries": deliveries}, status
+		}
+		return map[string]string{"error": value}, status
+
+	case "QACK", "QNACK":
+		if len(args) != 2 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		if command == "QACK" {
+			acked, status := ds.QAck(args[0], args[1])
+			if status == http.StatusConflict {
+				return wrongTypeMessage, status
+			}
+			return map[string]int{"acked": acked}, status
+		}
+		requeued, status := ds.QNack(args[0], args[1])
+		if status == http.StatusConflict {
+			return wrongTypeMessage, status
+		}
+		return map[string]int{"requeued": requeued}, status
+
+	case "QCONFIG":
+		if len(args) == 1 {
+			config, status := ds.QueueConfigOf(args[0])
+			if status == http.StatusOK {
+				return config, status
+			}
+			return wrongTypeMessage, status
+		}
+		if len(args) != 3 && len(args) != 5 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		var deadLetterKey *string
+		var maxDeliveries *int
+		for i := 1; i < len(args); i += 2 {
+			switch strings.ToUpper(args[i]) {
+			case "DLQ":
+				if deadLetterKey != nil {
+					return "Invalid Command", http.StatusBadRequest
+				}
+				deadLetterKey = &args[i+1]
+			case "MAXDELIVER":
+				n, err := strconv.Atoi(args[i+1])
+				if err != nil || n < 0 || maxDeliveries != nil {
+					return "Invalid Command", http.StatusBadRequest
+				}
+				maxDeliveries = &n
+			default:
+				return "Invalid Command", http.StatusBadRequest
+			}
+		}
+		return ds.QConfig(args[0], deadLetterKey, maxDeliveries)
+
+	case "QLEN":
+		if len(args) != 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		length, visible, capacity, status := ds.QLen(args[0])
+		if status == http.StatusOK {
+			return map[string]int{"length": length, "visible": visible, "capacity": capacity}, status
+		}
+		return wrongTypeMessage, status
+
+	case "QSTAT":
+		if len(args) != 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		if args[0] == "*" {
+			return map[string][]QueueStats{"queues": ds.QStatAll()}, http.StatusOK
+		}
+		stats, status := ds.QStat(args[0])
+		if status == http.StatusOK {
+			return stats, status
+		}
+		if status == http.StatusNotFound {
+			return "Key not exist", status
+		}
+		return wrongTypeMessage, status
+
+	case "BQPOP":
+		args, back := parsePopDirection(args)
+		if !ds.ValidateBQPopInput(args) {
+			return nil, http.StatusBadRequest
+		}
+		keys := args[:len(args)-1]
+		timeoutSeconds, _ := strconv.ParseFloat(args[len(args)-1], 64)
+		key, value, status := ds.BQPop(ctx, keys, timeoutSeconds, back)
+		if status == http.StatusOK {
+			return map[string]string{"key": key, "value": value}, status
+		}
+		return nil, status
+
+	case "DEL":
+		if len(args) < 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		deleted, status := ds.Del(args...)
+		return map[string]int{"deleted": deleted}, status
+
+	case "EXISTS":
+		if len(args) < 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		return map[string]int{"count": ds.Exists(args...)}, http.StatusOK
+
+	case "EXPIRE":
+		if len(args) != 2 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		seconds, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		applied, status := ds.Expire(args[0], seconds)
+		if status == http.StatusBadRequest {
+			return map[string]string{"error": "EXPIRE seconds value is too large"}, status
+		}
+		return map[string]int{"applied": applied}, status
+
+	case "EXPIREAT":
+		if len(args) != 2 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		at, ok := parseUnixTimestamp(args[1])
+		if !ok {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		applied, status := ds.ExpireAt(args[0], at)
+		return map[string]int{"applied": applied}, status
+
+	case "PERSIST":
+		if len(args) != 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		removed, status := ds.Persist(args[0])
+		return map[string]int{"removed": removed}, status
+
+	case "TTL":
+		if len(args) != 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		ttl, status := ds.TTL(args[0])
+		return map[string]int{"ttl": ttl}, status
+
+	case "PTTL":
+		if len(args) != 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		pttl, status := ds.PTTL(args[0])
+		return map[string]int64{"pttl": pttl}, status
+
+	case "INCR", "DECR":
+		if len(args) != 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		var value int64
+		var status int
+		if command == "INCR" {
+			value, status = ds.Incr(args[0])
+		} else {
+			value, status = ds.Decr(args[0])
+		}
+		return incrResult(value, status)
+
+	case "INCRBY", "DECRBY":
+		if len(args) != 2 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		delta, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		if command == "DECRBY" {
+			if delta == math.MinInt64 {
+				return incrResult(0, http.StatusBadRequest) // -delta would overflow
+			}
+			delta = -delta
+		}
+		return incrResult(ds.IncrBy(args[0], delta))
+
+	case "APPEND":
+		if len(args) != 2 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		length, status := ds.Append(args[0], args[1])
+		switch status {
+		case http.StatusOK:
+			return map[string]int{"length": length}, status
+		case http.StatusRequestEntityTooLarge:
+			return map[string]string{"error": valueTooLargeMessage}, status
+		case http.StatusInsufficientStorage:
+			return map[string]string{"error": outOfMemoryMessage}, status
+		}
+		return map[string]string{"error": wrongTypeMessage}, status
+
+	case "STRLEN":
+		if len(args) != 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		length, status := ds.StrLen(args[0])
+		if status == http.StatusOK || status == http.StatusNotFound {
+			return map[string]int{"length": length}, status
+		}
+		return map[string]string{"error": wrongTypeMessage}, status
+
+	case "HSET":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		added, status := ds.HSet(args[0], args[1:]...)
+		switch status {
+		case http.StatusOK:
+			return map[string]int{"added": added}, status
+		case http.StatusConflict:
+			return wrongTypeMessage, status
+		}
+		return outOfMemoryMessage, status
+
+	case "HGET":
+		if len(args) != 2 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		value, status := ds.HGet(args[0], args[1])
+		if status == http.StatusOK {
+			return map[string]string{"value": value}, status
+		}
+		return value, status
+
+	case "HDEL":
+		if len(args) < 2 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		deleted, status := ds.HDel(args[0], args[1:]...)
+		if status == http.StatusOK {
+			return map[string]int{"deleted": deleted}, status
+		}
+		return wrongTypeMessage, status
+
+	case "HINCRBY":
+		if len(args) != 3 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		delta, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		return incrResult(ds.HIncrBy(args[0], args[1], delta))
+
+	case "HINCRBYFLOAT":
+		if len(args) != 3 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		delta, err := strconv.ParseFloat(args[2], 64)
+		if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		value, status := ds.HIncrByFloat(args[0], args[1], delta)
+		switch status {
+		case http.StatusOK:
+			return map[string]json.Number{"value": json.Number(value)}, status
+		case http.StatusConflict:
+			return map[string]string{"error": wrongTypeMessage}, status
+		}
+		return map[string]string{"error": "value is not a valid float"}, status
+
+	case "HGETALL":
+		if len(args) != 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		fields, status := ds.HGetAll(args[0])
+		if status == http.StatusOK {
+			return map[string]map[string]string{"fields": fields}, status
+		}
+		return wrongTypeMessage, status
+
+	case "HLEN":
+		if len(args) != 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		length, status := ds.HLen(args[0])
+		if status == http.StatusOK {
+			return map[string]int{"length": length}, status
+		}
+		return wrongTypeMessage, status
+
+	case "SADD", "SREM":
+		if len(args) < 2 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		if command == "SADD" {
+			added, status := ds.SAdd(args[0], args[1:]...)
+			switch status {
+			case http.StatusOK:
+				return map[string]int{"added": added}, status
+			case http.StatusConflict:
+				return wrongTypeMessage, status
+			}
+			return outOfMemoryMessage, status
+		}
+		removed, status := ds.SRem(args[0], args[1:]...)
+		if status == http.StatusOK {
+			return map[string]int{"removed": removed}, status
+		}
+		return wrongTypeMessage, status
+
+	case "SISMEMBER":
+		if len(args) != 2 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		isMember, status := ds.SIsMember(args[0], args[1])
+		if status != http.StatusOK {
+			return wrongTypeMessage, status
+		}
+		if isMember {
+			return map[string]int{"member": 1}, status
+		}
+		return map[string]int{"member": 0}, status
+
+	case "SMEMBERS":
+		if len(args) != 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		members, status := ds.SMembers(args[0])
+		if status == http.StatusOK {
+			return map[string][]string{"members": members}, status
+		}
+		return wrongTypeMessage, status
+
+	case "SCARD":
+		if len(args) != 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		count, status := ds.SCard(args[0])
+		if status == http.StatusOK {
+			return map[string]int{"count": count}, status
+		}
+		return wrongTypeMessage, status
+
+	case "SINTER", "SUNION", "SDIFF":
+		if len(args) < 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		var members []string
+		var status int
+		switch command {
+		case "SINTER":
+			members, status = ds.SInter(args...)
+		case "SUNION":
+			members, status = ds.SUnion(args...)
+		default:
+			members, status = ds.SDiff(args...)
+		}
+		if status == http.StatusOK {
+			return map[string][]string{"members": members}, status
+		}
+		return wrongTypeMessage, status
+
+	case "SINTERSTORE", "SUNIONSTORE", "SDIFFSTORE":
+		if len(args) < 2 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		count, status := ds.SStore(strings.TrimSuffix(command, "STORE"), args[0], args[1:]...)
+		switch status {
+		case http.StatusOK:
+			return map[string]int{"count": count}, status
+		case http.StatusConflict:
+			return wrongTypeMessage, status
+		}
+		return outOfMemoryMessage, status
+
+	case "ZADD":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		members := make([]ZMember, 0, len(args)/2)
+		for i := 1; i < len(args); i += 2 {
+			score, ok := parseScore(args[i])
+			if !ok {
+				return "score is not a valid finite number", http.StatusBadRequest
+			}
+			members = append(members, ZMember{Member: args[i+1], Score: score})
+		}
+		added, status := ds.ZAdd(args[0], members...)
+		switch status {
+		case http.StatusOK:
+			return map[string]int{"added": added}, status
+		case http.StatusConflict:
+			return wrongTypeMessage, status
+		}
+		return outOfMemoryMessage, status
+
+	case "ZSCORE":
+		if len(args) != 2 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		score, status := ds.ZScore(args[0], args[1])
+		switch status {
+		case http.StatusOK:
+			return map[string]float64{"score": score}, status
+		case http.StatusNotFound:
+			return "Member not exist", status
+		}
+		return wrongTypeMessage, status
+
+	case "ZCARD":
+		if len(args) != 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		count, status := ds.ZCard(args[0])
+		if status == http.StatusOK {
+			return map[string]int{"count": count}, status
+		}
+		return wrongTypeMessage, status
+
+	case "ZRANGE", "ZRANGEBYSCORE":
+		withScores := len(args) == 4 && strings.ToUpper(args[3]) == "WITHSCORES"
+		if len(args) != 3 && !withScores {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		var members []ZMember
+		var status int
+		if command == "ZRANGE" {
+			start, err1 := strconv.Atoi(args[1])
+			stop, err2 := strconv.Atoi(args[2])
+			if err1 != nil || err2 != nil {
+				return "Invalid Command", http.StatusBadRequest
+			}
+			members, status = ds.ZRange(args[0], start, stop)
+		} else {
+			min, minExclusive, ok1 := parseScoreBound(args[1])
+			max, maxExclusive, ok2 := parseScoreBound(args[2])
+			if !ok1 || !ok2 {
+				return "min or max is not a valid number", http.StatusBadRequest
+			}
+			members, status = ds.ZRangeByScore(args[0], min, minExclusive, max, maxExclusive)
+		}
+		if status != http.StatusOK {
+			return wrongTypeMessage, status
+		}
+		if withScores {
+			return map[string][]ZMember{"members": members}, status
+		}
+		return map[string][]string{"members": zmemberNames(members)}, status
+
+	case "ZPOPMIN", "ZPOPMAX":
+		if len(args) != 1 && len(args) != 2 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		count := 1
+		if len(args) == 2 {
+			var err error
+			if count, err = strconv.Atoi(args[1]); err != nil || count < 1 {
+				return "Invalid Command", http.StatusBadRequest
+			}
+		}
+		var members []ZMember
+		var status int
+		if command == "ZPOPMIN" {
+			members, status = ds.ZPopMin(args[0], count)
+		} else {
+			members, status = ds.ZPopMax(args[0], count)
+		}
+		if status == http.StatusOK {
+			return map[string][]ZMember{"members": members}, status
+		}
+		return wrongTypeMessage, status
+
+	case "BZPOPMIN", "BZPOPMAX":
+		if !ds.ValidateBQPopInput(args) {
+			return nil, http.StatusBadRequest
+		}
+		keys := args[:len(args)-1]
+		timeoutSeconds, _ := strconv.ParseFloat(args[len(args)-1], 64)
+		key, m, status := ds.BZPop(ctx, keys, timeoutSeconds, command == "BZPOPMAX")
+		if status == http.StatusOK {
+			return map[string]interface{}{"key": key, "member": m.Member, "score": m.Score}, status
+		}
+		return nil, status
+
+	case "SETBIT":
+		if len(args) != 3 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		offset, ok := parseBitOffset(args[1])
+		if !ok {
+			return map[string]string{"error": bitOffsetMessage}, http.StatusBadRequest
+		}
+		if args[2] != "0" && args[2] != "1" {
+			return map[string]string{"error": "bit is not 0 or 1"}, http.StatusBadRequest
+		}
+		bit, status := ds.SetBit(args[0], offset, int(args[2][0]-'0'))
+		switch status {
+		case http.StatusOK:
+			return map[string]int{"bit": bit}, status
+		case http.StatusConflict:
+			return wrongTypeMessage, status
+		case http.StatusRequestEntityTooLarge:
+			return valueTooLargeMessage, status
+		}
+		return outOfMemoryMessage, status
+
+	case "GETBIT":
+		if len(args) != 2 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		offset, ok := parseBitOffset(args[1])
+		if !ok {
+			return map[string]string{"error": bitOffsetMessage}, http.StatusBadRequest
+		}
+		bit, status := ds.GetBit(args[0], offset)
+		if status == http.StatusOK {
+			return map[string]int{"bit": bit}, status
+		}
+		return wrongTypeMessage, status
+
+	case "BITCOUNT":
+		if len(args) != 1 && len(args) != 3 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		start, stop := 0, -1
+		if len(args) == 3 {
+			var err1, err2 error
+			start, err1 = strconv.Atoi(args[1])
+			stop, err2 = strconv.Atoi(args[2])
+			if err1 != nil || err2 != nil {
+				return "Invalid Command", http.StatusBadRequest
+			}
+		}
+		count, status := ds.BitCount(args[0], start, stop)
+		if status == http.StatusOK {
+			return map[string]int{"count": count}, status
+		}
+		return wrongTypeMessage, status
+
+	case "PFADD":
+		if len(args) < 2 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		updated, status := ds.PFAdd(args[0], args[1:]...)
+		switch status {
+		case http.StatusOK:
+			if updated {
+				return map[string]int{"updated": 1}, status
+			}
+			return map[string]int{"updated": 0}, status
+		case http.StatusConflict:
+			return wrongTypeMessage, status
+		}
+		return outOfMemoryMessage, status
+
+	case "PFCOUNT":
+		if len(args) < 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		count, status := ds.PFCount(args...)
+		if status == http.StatusOK {
+			return map[string]int64{"count": count}, status
+		}
+		return wrongTypeMessage, status
+
+	case "PFMERGE":
+		if len(args) < 2 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		return ds.PFMerge(args[0], args[1:]...)
+
+	case "XADD":
+		if len(args) != 2 && (len(args) != 4 || strings.ToUpper(args[1]) != "MAXLEN") {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		maxLen := -1
+		if len(args) == 4 {
+			var err error
+			if maxLen, err = strconv.Atoi(args[2]); err != nil || maxLen < 0 {
+				return map[string]string{"error": "MAXLEN must be a non-negative integer"}, http.StatusBadRequest
+			}
+		}
+		id, status := ds.XAdd(args[0], args[len(args)-1], maxLen)
+		if status == http.StatusOK {
+			return map[string]string{"id": id}, status
+		}
+		return id, status
+
+	case "XLEN":
+		if len(args) != 1 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		length, status := ds.XLen(args[0])
+		if status == http.StatusOK {
+			return map[string]int{"length": length}, status
+		}
+		return wrongTypeMessage, status
+
+	case "XREAD":
+		if len(args) < 2 || len(args)%2 != 0 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		count, block, timeoutSeconds := 0, false, 0.0
+		for i := 2; i < len(args); i += 2 {
+			var ok bool
+			switch strings.ToUpper(args[i]) {
+			case "COUNT":
+				n, err := strconv.Atoi(args[i+1])
+				ok = err == nil && n > 0
+				count = n
+			case "BLOCK":
+				timeoutSeconds, ok = parseBlockTimeout(args[i+1])
+				block = true
+			}
+			if !ok {
+				return "Invalid Command", http.StatusBadRequest
+			}
+		}
+		entries, status := ds.XRead(ctx, args[0], args[1], count, block, timeoutSeconds)
+		switch status {
+		case http.StatusOK:
+			return map[string][]StreamEntry{"entries": entries}, status
+		case http.StatusBadRequest:
+			return map[string]string{"error": "invalid stream ID"}, status
+		case http.StatusConflict:
+			return wrongTypeMessage, status
+		}
+		return nil, status
+
+	case "JSET":
+		if len(args) != 3 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		return ds.JSet(args[0], args[1], args[2])
+
+	case "JGET":
+		if len(args) != 2 {
+			return "Invalid Command", http.StatusBadRequest
+		}
+		value, reason, status := ds.JGet(args[0], args[1])
+		if status == http.StatusOK {
+			return map[string]interface{}{"value": value}, status
+		}
+		return reason, status
+
+	default:
+		return unknownCommand("Invalid Command"), http.StatusBadRequest
+	}
+}
+
+// errorMessage extracts a human readable message from a failed command result
+func errorMessage(result interface{}, status int) string {
+	switch v := result.(type) {
+	case string:
+		if v != "" {
+			return v
+		}
+	case unknownCommand:
+		return string(v)
+	case map[string]string:
+		if msg := v["error"]; msg != "" {
+			return msg
+		}
+	}
+	return http.StatusText(status)
+}
+
+// errorResponse wraps a failed command result in the standard error shape
+// {"error": "<message>", "code": <status>}. Any other fields the command
+// returned, such as {"ttl": -2}, are kept alongside.
+func errorResponse(result interface{}, status int) map[string]interface{} {
+	body := map[string]interface{}{}
+	if _, isString := result.(string); !isString && result != nil {
+		var fields map[string]interface{}
+		if encoded, err := json.Marshal(result); err == nil && json.Unmarshal(encoded, &fields) == nil {
+			for k, v := range fields {
+				body[k] = v
+			}
+		}
+	}
+	body["error"] = errorMessage(result, status)
+	body["code"] = status
+
+	return body
+}
+
+// decodeJSONBody decodes the request body into v, reading at most limit
+// bytes so an oversized body is never held in memory. On failure it writes
+// the error response and returns false.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, limit int64, v interface{}) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit)).Decode(v)
+	if err == nil {
+		return true
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeJSON(w, http.StatusRequestEntityTooLarge, errorResponse("request body too large", http.StatusRequestEntityTooLarge))
+	} else {
+		writeJSON(w, http.StatusBadRequest, errorResponse("Invalid JSON body", http.StatusBadRequest))
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// resolvePort picks the listen port from the flag value, then the PORT
+// environment variable, then DefaultPort, and checks that it is valid.
+func resolvePort(flagValue string) (string, error) {
+	port := flagValue
+	if port == "" {
+		port = os.Getenv("PORT")
+	}
+	if port == "" {
+		port = DefaultPort
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid port %q: must be a number between 1 and 65535", port)
+	}
+
+	return port, nil
+}
+
+func main() {
+	portFlag := flag.String("port", "", "port to listen on (overrides the PORT environment variable, default "+DefaultPort+")")
+	sweepInterval := flag.Duration("sweep-interval", DefaultSweepInterval, "interval between background sweeps of expired keys")
+	sweepBatch := flag.Int("sweep-batch", DefaultSweepBatchSize, "keys sampled per expiry sweep burst (0 to scan all keys at once)")
+	var opts Options
+	flag.IntVar(&opts.KeysLimit, "keys-limit", DefaultKeysLimit, "maximum number of keys returned by KEYS (0 for no limit)")
+	flag.BoolVar(&opts.AllowFlush, "allow-flush", false, "allow the FLUSHALL command")
+	flag.IntVar(&opts.MaxKeys, "max-keys", 0, "number of keys above which keys are evicted (0 for no limit)")
+	flag.IntVar(&opts.MaxBytes, "max-bytes", 0, "approximate memory in bytes above which keys are evicted (0 for no limit)")
+	flag.StringVar(&opts.EvictionPolicy, "eviction-policy", EvictionLRU, "what to do when a limit is reached: lru, lfu, random, volatile-ttl or noeviction")
+	respPort := flag.String("resp-port", "", "port for the RESP (Redis protocol) TCP listener, disabled when empty")
+	snapshotPath := flag.String("snapshot", "", "file to load data from at startup and save it to on shutdown")
+	flag.IntVar(&opts.MaxValueBytes, "max-value-bytes", DefaultMaxValueBytes, "largest string value accepted by SET, MSET, GETSET and APPEND, in bytes (0 for no limit)")
+	flag.Int64Var(&opts.MaxBodyBytes, "max-body-bytes", DefaultMaxBodyBytes, "largest HTTP request body, or RESP command, accepted, in bytes")
+	flag.DurationVar(&opts.MaxBlockTimeout, "max-block-timeout", 0, "longest a BQPOP may wait, capping larger and zero (forever) timeouts (0 for no cap)")
+	authToken := flag.String("auth-token", "", "bearer token required on /command/, /pipeline, /stats and /metrics, and by AUTH over RESP (overrides the AUTH_TOKEN environment variable; empty leaves the server open)")
+	quiet := flag.Bool("quiet", false, "disable per-request logging")
+	flag.Parse()
+
+	port, err := resolvePort(*portFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if !validEvictionPolicy(opts.EvictionPolicy) {
+		fmt.Fprintf(os.Stderr, "invalid eviction policy %q: must be lru, lfu, random, volatile-ttl or noeviction\n", opts.EvictionPolicy)
+		os.Exit(1)
+	}
+
+	opts.AuthToken = *authToken
+	if opts.AuthToken == "" {
+		opts.AuthToken = os.Getenv("AUTH_TOKEN")
+	}
+
+	datastore := NewDatastore(opts)
+	if *snapshotPath != "" {
+		if err := datastore.LoadSnapshot(*snapshotPath); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to load snapshot:", err)
+			os.Exit(1)
+		}
+	}
+	if *sweepInterval > 0 {
+		datastore.StartExpiryReaper(*sweepInterval, *sweepBatch)
+	}
+
+	handleCommand := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeJSON(w, http.StatusMethodNotAllowed, errorResponse(nil, http.StatusMethodNotAllowed))
+			return
+		}
+
+		contentType := r.Header.Get("Content-Type")
+		if contentType != "application/json" {
+			writeJSON(w, http.StatusBadRequest, errorResponse("Content-Type must be application/json", http.StatusBadRequest))
+			return
+		}
+
+		var jsonRequest struct {
+			Command string `json:"command"`
+		}
+		if !decodeJSONBody(w, r, datastore.maxBodyBytes(), &jsonRequest) {
+			return
+		}
+
+		command, _, _ := datastore.ParseCommand(jsonRequest.Command)
+		result, status := datastore.HandleCommand(r.Context(), jsonRequest.Command)
+		recordCommand(w, command, result)
+		if status != http.StatusOK {
+			result = errorResponse(result, status)
+		}
+
+		writeJSON(w, status, result)
+	}
+	handleCommand = datastore.requireAuth(handleCommand)
+	if !*quiet {
+		handleCommand = logRequests(handleCommand)
+	}
+	http.HandleFunc("/command/", handleCommand)
+
+	handlePipeline := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeJSON(w, http.StatusMethodNotAllowed, errorResponse(nil, http.StatusMethodNotAllowed))
+			return
+		}
+
+		contentType := r.Header.Get("Content-Type")
+		if contentType != "application/json" {
+			writeJSON(w, http.StatusBadRequest, errorResponse("Content-Type must be application/json", http.StatusBadRequest))
+			return
+		}
+
+		var jsonRequest struct {
+			Commands []string `json:"commands"`
+		}
+		if !decodeJSONBody(w, r, datastore.maxBodyBytes(), &jsonRequest) {
+			return
+		}
+		recordCommand(w, "PIPELINE", nil)
+
+		results := datastore.Pipeline(r.Context(), jsonRequest.Commands)
+		writeJSON(w, http.StatusOK, map[string][]PipelineResult{"results": results})
+	}
+	handlePipeline = datastore.requireAuth(handlePipeline)
+	if !*quiet {
+		handlePipeline = logRequests(handlePipeline)
+	}
+	http.HandleFunc("/pipeline", handlePipeline)
+
+	started := time.Now()
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeJSON(w, http.StatusMethodNotAllowed, errorResponse(nil, http.StatusMethodNotAllowed))
+			return
+		}
+
+		uptime := int64(time.Since(started).Seconds())
+		if !datastore.Healthy(HealthCheckTimeout) {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "unavailable", "uptime_seconds": uptime})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "uptime_seconds": uptime})
+	})
+
+	http.HandleFunc("/metrics", datastore.requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeJSON(w, http.StatusMethodNotAllowed, errorResponse(nil, http.StatusMethodNotAllowed))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		datastore.WriteMetrics(w)
+	}))
+
+	http.HandleFunc("/stats", datastore.requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeJSON(w, http.StatusMethodNotAllowed, errorResponse(nil, http.StatusMethodNotAllowed))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, datastore.Stats())
+	}))
+
+	var respListener net.Listener
+	if *respPort != "" {
+		if _, err := resolvePort(*respPort); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		respListener, err = net.Listen("tcp", ":"+*respPort)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Starting RESP listener on port %s...\n", *respPort)
+		go datastore.ServeRESP(respListener)
+	}
+
+	server := &http.Server{Addr: ":" + port}
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		fmt.Println("Shutting down server...")
+		datastore.Close() // Release blocked BQPOP callers before waiting on them
+		if respListener != nil {
+			respListener.Close()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), ShutdownGracePeriod)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			fmt.Fprintln(os.Stderr, "Shutdown error:", err)
+		}
+
+		if *snapshotPath != "" {
+			if err := datastore.SaveSnapshot(*snapshotPath); err != nil {
+				fmt.Fprintln(os.Stderr, "Failed to save snapshot:", err)
+			}
+		}
+	}()
+
+	fmt.Printf("Starting server on port %s...\n", port)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	<-shutdownDone
+}
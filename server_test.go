@@ -0,0 +1,1796 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// do runs command against ds and returns its result as JSON, the way the
+// HTTP front-end would send it, along with the status
+func do(t *testing.T, ds *Datastore, command string) (string, int) {
+	t.Helper()
+
+	result, status := ds.HandleCommand(context.Background(), command)
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("%s: encoding result %#v: %v", command, result, err)
+	}
+	return string(encoded), status
+}
+
+// step is one command of a scripted test and the result it should give
+type step struct {
+	command string
+	want    string
+	status  int
+}
+
+// runSteps runs steps in order against ds, failing on the first mismatch
+func runSteps(t *testing.T, ds *Datastore, steps []step) {
+	t.Helper()
+
+	for _, s := range steps {
+		got, status := do(t, ds, s.command)
+		if got != s.want || status != s.status {
+			t.Fatalf("%s = %s, %d, want %s, %d", s.command, got, status, s.want, s.status)
+		}
+	}
+}
+
+// waitFor polls cond, which is called with the write lock held, until it
+// holds or a second has passed
+func waitFor(t *testing.T, ds *Datastore, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		ds.mu.Lock()
+		ok := cond()
+		ds.mu.Unlock()
+		if ok {
+			return
+		}
+	}
+	t.Fatal("condition not met within a second")
+}
+
+// async runs command in the background and returns a channel for its result
+func async(t *testing.T, ds *Datastore, command string) <-chan step {
+	results := make(chan step, 1)
+	go func() {
+		got, status := do(t, ds, command)
+		results <- step{command, got, status}
+	}()
+	return results
+}
+
+func TestBQPushRefusesValuesThatCanNeverFit(t *testing.T) {
+	ds := NewDatastore(Options{})
+	runSteps(t, ds, []step{
+		{"QCAP q 2", `"OK"`, http.StatusOK},
+		{"QPUSH q a b", `"Value is pushed successfully"`, http.StatusOK},
+	})
+
+	waiting := async(t, ds, "BQPUSH q 5 c")
+	waitFor(t, ds, func() bool { return len(ds.pushers["q"]) == 1 })
+
+	// Refused at once rather than queued behind the waiting pusher, where it
+	// used to block every later BQPUSH on the key
+	runSteps(t, ds, []step{
+		{"BQPUSH q 0 x y z", `"queue is full"`, http.StatusTooManyRequests},
+		{"QPOP q", `{"value":"a"}`, http.StatusOK},
+	})
+	if got := <-waiting; got.status != http.StatusOK {
+		t.Fatalf("waiting BQPUSH = %s, %d", got.want, got.status)
+	}
+
+	runSteps(t, ds, []step{
+		{"QPOP q", `{"value":"b"}`, http.StatusOK},
+		{"BQPUSH q 1 d", `"Value is pushed successfully"`, http.StatusOK},
+	})
+}
+
+func TestServePushersFailsPushersPastALoweredCapacity(t *testing.T) {
+	ds := NewDatastore(Options{})
+	runSteps(t, ds, []step{
+		{"QCAP q 3", `"OK"`, http.StatusOK},
+		{"QPUSH q a b c", `"Value is pushed successfully"`, http.StatusOK},
+	})
+
+	tooBig := async(t, ds, "BQPUSH q 5 x y")
+	waitFor(t, ds, func() bool { return len(ds.pushers["q"]) == 1 })
+	small := async(t, ds, "BQPUSH q 5 z")
+	waitFor(t, ds, func() bool { return len(ds.pushers["q"]) == 2 })
+
+	runSteps(t, ds, []step{{"QCAP q 1", `"OK"`, http.StatusOK}})
+	if got := <-tooBig; got.status != http.StatusTooManyRequests {
+		t.Fatalf("BQPUSH of two values into a capacity of one = %s, %d", got.want, got.status)
+	}
+
+	runSteps(t, ds, []step{
+		{"QPOP q 3", `{"values":["a","b","c"]}`, http.StatusOK},
+	})
+	if got := <-small; got.status != http.StatusOK {
+		t.Fatalf("BQPUSH behind the failed pusher = %s, %d", got.want, got.status)
+	}
+	runSteps(t, ds, []step{{"QPOP q", `{"value":"z"}`, http.StatusOK}})
+}
+
+func TestExpiriesTooLargeForADurationAreRejected(t *testing.T) {
+	tests := []struct {
+		command string
+		status  int
+	}{
+		{"EXPIRE e 9999999999999", http.StatusBadRequest},
+		{"EXPIRE e -9999999999999", http.StatusBadRequest},
+		{"SET k v EX 9999999999999", http.StatusBadRequest},
+		{"SET k v PX 9223372036854775807", http.StatusBadRequest},
+		{"SET k v PX 9223372036854", http.StatusOK},
+		{"SET k v EX 9223372036", http.StatusOK},
+		{"EXPIRE e 9223372036", http.StatusOK},
+		{"QRESERVE q 9999999999999", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			ds := NewDatastore(Options{})
+			runSteps(t, ds, []step{
+				{"SET e v", `"Enter data sucessfull"`, http.StatusOK},
+				{"QPUSH q a", `"Value is pushed successfully"`, http.StatusOK},
+			})
+			if got, status := do(t, ds, tt.command); status != tt.status {
+				t.Fatalf("%s = %s, %d, want status %d", tt.command, got, status, tt.status)
+			}
+			// An overflow used to wrap around into the past and drop the key
+			runSteps(t, ds, []step{{"EXISTS e", `{"count":1}`, http.StatusOK}})
+		})
+	}
+}
+
+func TestFarFutureTimestampsAreRejected(t *testing.T) {
+	tests := []struct {
+		command string
+		status  int
+	}{
+		{"EXPIREAT e 99999999999999", http.StatusBadRequest},
+		{"EXPIREAT e 9223372036854775807", http.StatusBadRequest},
+		{"SET e v EXAT 99999999999999", http.StatusBadRequest},
+		{"EXPIREAT e 9999999999", http.StatusOK},
+		{"SET e v EXAT 9999999999", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			ds := NewDatastore(Options{})
+			runSteps(t, ds, []step{{"SET e v", `"Enter data sucessfull"`, http.StatusOK}})
+			if got, status := do(t, ds, tt.command); status != tt.status {
+				t.Fatalf("%s = %s, %d, want status %d", tt.command, got, status, tt.status)
+			}
+			// The TTL was once negative here, as if the key had no expiry
+			got, _ := do(t, ds, "TTL e")
+			var ttl struct{ TTL int64 }
+			if err := json.Unmarshal([]byte(got), &ttl); err != nil || (ttl.TTL > 0) != (tt.status == http.StatusOK) {
+				t.Errorf("TTL e after %s = %s", tt.command, got)
+			}
+		})
+	}
+}
+
+func TestTTL(t *testing.T) {
+	tests := []struct {
+		name   string
+		expiry time.Duration // From now; 0 leaves the key without one
+		ttl    string
+		pttl   string // Left out where it would depend on timing
+		status int
+	}{
+		{"no expiry", 0, `{"ttl":-1}`, `{"pttl":-1}`, http.StatusOK},
+		{"rounds up to whole seconds", 1500*time.Millisecond + 500*time.Microsecond, `{"ttl":2}`, "", http.StatusOK},
+		{"expired but not yet purged", -time.Millisecond, `{"ttl":-2}`, `{"pttl":-2}`, http.StatusNotFound},
+		{"largest Duration", math.MaxInt64, `{"ttl":9223372037}`, "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := NewDatastore(Options{})
+			runSteps(t, ds, []step{{"SET k v", `"Enter data sucessfull"`, http.StatusOK}})
+			if tt.expiry != 0 {
+				ds.mu.Lock()
+				ds.data["k"].expiry = time.Now().Add(tt.expiry)
+				ds.mu.Unlock()
+			}
+
+			runSteps(t, ds, []step{{"TTL k", tt.ttl, tt.status}})
+			if tt.pttl != "" {
+				runSteps(t, ds, []step{{"PTTL k", tt.pttl, tt.status}})
+			}
+		})
+	}
+
+	runSteps(t, NewDatastore(Options{}), []step{{"TTL missing", `{"ttl":-2}`, http.StatusNotFound}})
+}
+
+func TestParseSetOptions(t *testing.T) {
+	tests := []struct {
+		tokens      []string
+		ok          bool
+		conditional string
+		keepTTL     bool
+		expires     bool
+	}{
+		{nil, true, "", false, false},
+		{[]string{"NX"}, true, "NX", false, false},
+		{[]string{"xx"}, true, "XX", false, false},
+		{[]string{"NX", "EX30"}, true, "NX", false, true},
+		{[]string{"EX", "30", "NX"}, true, "NX", false, true},
+		{[]string{"PX", "1500"}, true, "", false, true},
+		{[]string{"EXAT", "9999999999"}, true, "", false, true},
+		{[]string{"EXAT9999999999"}, true, "", false, true},
+		{[]string{"KEEPTTL", "XX"}, true, "XX", true, false},
+		{[]string{"EX", "AT5"}, false, "", false, false},
+		{[]string{"PX", "AT5"}, false, "", false, false},
+		{[]string{"EX"}, false, "", false, false},
+		{[]string{"EX", "ten"}, false, "", false, false},
+		{[]string{"NX", "XX"}, false, "", false, false},
+		{[]string{"NX", "NX"}, false, "", false, false},
+		{[]string{"EX10", "PX10"}, false, "", false, false},
+		{[]string{"KEEPTTL", "EX10"}, false, "", false, false},
+		{[]string{"EX0"}, false, "", false, false},
+		{[]string{"BOGUS"}, false, "", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.tokens, " "), func(t *testing.T) {
+			opts, err := parseSetOptions(tt.tokens)
+			if (err == nil) != tt.ok {
+				t.Fatalf("error = %v, want ok %v", err, tt.ok)
+			}
+			if !tt.ok {
+				return
+			}
+			if opts.conditional != tt.conditional || opts.keepTTL != tt.keepTTL || opts.expiry.IsZero() == tt.expires {
+				t.Errorf("got %+v", opts)
+			}
+		})
+	}
+}
+
+func TestSetEx(t *testing.T) {
+	tests := []struct {
+		command string
+		status  int
+	}{
+		{"SETEX k 10 v", http.StatusOK},
+		{"SETEX k AT5 v", http.StatusBadRequest},
+		{"SETEX k ten v", http.StatusBadRequest},
+		{"SETEX k 0 v", http.StatusBadRequest},
+		{"SETEX k -5 v", http.StatusBadRequest},
+		{"SETEX k 9999999999999 v", http.StatusBadRequest},
+		{"SETEX k 10", http.StatusBadRequest},
+		{"SETEX k", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			ds := NewDatastore(Options{})
+			if got, status := do(t, ds, tt.command); status != tt.status {
+				t.Fatalf("%s = %s, %d, want status %d", tt.command, got, status, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				runSteps(t, ds, []step{{"EXISTS k", `{"count":0}`, http.StatusOK}})
+				return
+			}
+			runSteps(t, ds, []step{
+				{"GET k", `{"value":"v"}`, http.StatusOK},
+				{"TTL k", `{"ttl":10}`, http.StatusOK},
+			})
+		})
+	}
+}
+
+func TestCopy(t *testing.T) {
+	ds := NewDatastore(Options{})
+	runSteps(t, ds, []step{
+		{"QPUSH q a b", `"Value is pushed successfully"`, http.StatusOK},
+		{"SET s v EX100", `"Enter data sucessfull"`, http.StatusOK},
+		{"COPY s t", `"Key is copied successfully"`, http.StatusOK},
+		{"GET t", `{"value":"v"}`, http.StatusOK},
+		{"TTL t", `{"ttl":100}`, http.StatusOK},
+		{"COPY s t NX", `"Key already exists"`, http.StatusConflict},
+		{"COPY missing t", `"Key not exist"`, http.StatusNotFound},
+		{"COPY s s", `"source and destination are the same key"`, http.StatusBadRequest},
+	})
+
+	reserved, _ := do(t, ds, "QRESERVE q 30")
+	var reservation struct{ ID string }
+	if err := json.Unmarshal([]byte(reserved), &reservation); err != nil {
+		t.Fatalf("QRESERVE q 30 = %s", reserved)
+	}
+
+	runSteps(t, ds, []step{
+		// Used to replace q with a copy that had lost its reservations
+		{"COPY q q", `"source and destination are the same key"`, http.StatusBadRequest},
+		{"COPY q r", `"Key is copied successfully"`, http.StatusOK},
+		{"QACK r " + reservation.ID, `{"acked":0}`, http.StatusNotFound},
+		{"QACK q " + reservation.ID, `{"acked":1}`, http.StatusOK},
+		{"QPOP r 2", `{"values":["b"]}`, http.StatusOK},
+		// Deep copied, so pushing to one leaves the other alone
+		{"QPUSH q c", `"Value is pushed successfully"`, http.StatusOK},
+		{"QLEN r", `{"capacity":0,"length":0,"visible":0}`, http.StatusOK},
+	})
+}
+
+func TestTokenizeCommand(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want []string
+		ok   bool
+	}{
+		{"SET k v", []string{"SET", "k", "v"}, true},
+		{"  SET\tk   v  ", []string{"SET", "k", "v"}, true},
+		{`SET k "hello world"`, []string{"SET", "k", "hello world"}, true},
+		{`SET k 'hello world'`, []string{"SET", "k", "hello world"}, true},
+		{`SET k ""`, []string{"SET", "k", ""}, true},
+		{`SET k "say \"hi\""`, []string{"SET", "k", `say "hi"`}, true},
+		{`SET k "a b c"`, []string{"SET", "k", "a b c"}, true},
+		{`SET k "{\"a\": \"b c\"}"`, []string{"SET", "k", `{"a": "b c"}`}, true},
+		{`SET k "a"b`, []string{"SET", "k", "ab"}, true},
+		{"SET msg don't", []string{"SET", "msg", "don't"}, true},
+		{`SET msg it's "a test"`, []string{"SET", "msg", "it's", "a test"}, true},
+		{`SET k 5"`, []string{"SET", "k", `5"`}, true},
+		{`SET k "unterminated`, nil, false},
+		{`SET k 'it\'s'`, []string{"SET", "k", "it's"}, true},
+		{`SET k "trailing\`, nil, false},
+		{"", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := tokenizeCommand(tt.raw)
+			if (err == nil) != tt.ok {
+				t.Fatalf("error = %v, want ok %v", err, tt.ok)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	runSteps(t, NewDatastore(Options{}), []step{
+		{"SET msg don't", `"Enter data sucessfull"`, http.StatusOK},
+		{"GET msg", `{"value":"don't"}`, http.StatusOK},
+	})
+}
+
+// TestDelayedValuesWakeConsumersWhereverTheyAre checks that blocked consumers
+// are served once delayed values become visible, even when the values have
+// left the key they were pushed to
+func TestDelayedValuesWakeConsumersWhereverTheyAre(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T) *Datastore // Leaves a delayed value in "dst"
+	}{
+		{"pushed", func(t *testing.T) *Datastore {
+			ds := NewDatastore(Options{})
+			runSteps(t, ds, []step{{"QPUSH dst DELAY 0.2 a", `"Value is pushed successfully"`, http.StatusOK}})
+			return ds
+		}},
+		{"renamed", func(t *testing.T) *Datastore {
+			ds := NewDatastore(Options{})
+			runSteps(t, ds, []step{
+				{"QPUSH src DELAY 0.2 a", `"Value is pushed successfully"`, http.StatusOK},
+				{"RENAME src dst", `"Key is renamed successfully"`, http.StatusOK},
+			})
+			return ds
+		}},
+		{"copied", func(t *testing.T) *Datastore {
+			ds := NewDatastore(Options{})
+			runSteps(t, ds, []step{
+				{"QPUSH src DELAY 0.2 a", `"Value is pushed successfully"`, http.StatusOK},
+				{"COPY src dst", `"Key is copied successfully"`, http.StatusOK},
+			})
+			return ds
+		}},
+		{"restored from a snapshot", func(t *testing.T) *Datastore {
+			saved := NewDatastore(Options{})
+			runSteps(t, saved, []step{{"QPUSH dst DELAY 0.2 a", `"Value is pushed successfully"`, http.StatusOK}})
+			path := filepath.Join(t.TempDir(), "snapshot.json")
+			if err := saved.SaveSnapshot(path); err != nil {
+				t.Fatal(err)
+			}
+			ds := NewDatastore(Options{})
+			if err := ds.LoadSnapshot(path); err != nil {
+				t.Fatal(err)
+			}
+			return ds
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := tt.setup(t)
+			runSteps(t, ds, []step{{"QPOP dst", `{"error":"Q is empty so nothing can be popped!!"}`, http.StatusBadRequest}})
+
+			got := <-async(t, ds, "BQPOP dst 5")
+			if got.want != `{"key":"dst","value":"a"}` || got.status != http.StatusOK {
+				t.Fatalf("BQPOP dst 5 = %s, %d", got.want, got.status)
+			}
+		})
+	}
+}
+
+// underReadLock runs command while another reader holds the read lock, which
+// only completes if command needs no more than the read lock itself
+func underReadLock(t *testing.T, ds *Datastore, command string) (string, int) {
+	t.Helper()
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	select {
+	case got := <-async(t, ds, command):
+		return got.want, got.status
+	case <-time.After(time.Second):
+		t.Fatalf("%s waited for the write lock", command)
+		return "", 0
+	}
+}
+
+func TestQLenAndQPeek(t *testing.T) {
+	ds := NewDatastore(Options{})
+	runSteps(t, ds, []step{
+		{"QPUSH q a b c", `"Value is pushed successfully"`, http.StatusOK},
+		{"QPUSH q DELAY 60 d", `"Value is pushed successfully"`, http.StatusOK},
+		{"SET s v", `"Enter data sucessfull"`, http.StatusOK},
+		{"QPUSH gone EX1 x", `"Value is pushed successfully"`, http.StatusOK},
+		{"QCAP bounded 5", `"OK"`, http.StatusOK},
+		{"QPUSH bounded a", `"Value is pushed successfully"`, http.StatusOK},
+	})
+	ds.mu.Lock()
+	ds.data["gone"].expiry = time.Now().Add(-time.Second)
+	ds.mu.Unlock()
+
+	tests := []step{
+		{"QLEN q", `{"capacity":0,"length":4,"visible":3}`, http.StatusOK},
+		{"QLEN bounded", `{"capacity":5,"length":1,"visible":1}`, http.StatusOK},
+		{"QLEN missing", `{"capacity":0,"length":0,"visible":0}`, http.StatusOK},
+		{"QLEN s", `"` + wrongTypeMessage + `"`, http.StatusConflict},
+		{"QPEEK q", `{"value":"a"}`, http.StatusOK},
+		{"QPEEK q 2", `{"values":["a","b"]}`, http.StatusOK},
+		{"QPEEK q 10", `{"values":["a","b","c"]}`, http.StatusOK},
+		{"QPEEK q 0", `{"values":[]}`, http.StatusOK},
+		{"QPEEK q -1", `"Invalid Command"`, http.StatusBadRequest},
+		{"QPEEK missing", `"Key not exist"`, http.StatusNotFound},
+		{"QPEEK s", `"` + wrongTypeMessage + `"`, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if got, status := underReadLock(t, ds, tt.command); got != tt.want || status != tt.status {
+			t.Errorf("%s = %s, %d, want %s, %d", tt.command, got, status, tt.want, tt.status)
+		}
+	}
+
+	// Peeking leaves the queue as it was. An expired queue reads as missing
+	// and is purged once the read lock is released.
+	runSteps(t, ds, []step{
+		{"QPOP q 4", `{"values":["a","b","c"]}`, http.StatusOK},
+		{"QLEN gone", `{"capacity":0,"length":0,"visible":0}`, http.StatusOK},
+	})
+	if _, ok := ds.data["gone"]; ok {
+		t.Error("expired queue still stored after QLEN")
+	}
+}
+
+func TestReadCommandsTakeOnlyTheReadLock(t *testing.T) {
+	ds := NewDatastore(Options{})
+	runSteps(t, ds, []step{
+		{"QPUSH q a b c", `"Value is pushed successfully"`, http.StatusOK},
+		{"HSET h f v", `{"added":1}`, http.StatusOK},
+		{"SADD s a b", `{"added":2}`, http.StatusOK},
+		{"ZADD z 1 a 2 b", `{"added":2}`, http.StatusOK},
+		{"SETBIT b 7 1", `{"bit":0}`, http.StatusOK},
+		{"PFADD p x y", `{"updated":1}`, http.StatusOK},
+
+		{"JSET j a.b 1", `"Enter data sucessfull"`, http.StatusOK},
+	})
+	if _, status := do(t, ds, "XADD x e"); status != http.StatusOK {
+		t.Fatalf("XADD x e = %d", status)
+	}
+
+	tests := []step{
+		{"QRANGE q 0 -1", `{"items":["a","b","c"],"values":["a","b","c"]}`, http.StatusOK},
+		{"QCONFIG q", `{"dlq":"","max_deliver":0,"dead_lettered":0}`, http.StatusOK},
+		{"HGET h f", `{"value":"v"}`, http.StatusOK},
+		{"HGETALL h", `{"fields":{"f":"v"}}`, http.StatusOK},
+		{"HLEN h", `{"length":1}`, http.StatusOK},
+		{"SISMEMBER s a", `{"member":1}`, http.StatusOK},
+		{"SMEMBERS s", `{"members":["a","b"]}`, http.StatusOK},
+		{"SCARD s", `{"count":2}`, http.StatusOK},
+		{"ZSCORE z b", `{"score":2}`, http.StatusOK},
+		{"ZRANGE z 0 -1", `{"members":["a","b"]}`, http.StatusOK},
+		{"ZRANGEBYSCORE z 2 +inf", `{"members":["b"]}`, http.StatusOK},
+		{"ZCARD z", `{"count":2}`, http.StatusOK},
+		{"GETBIT b 7", `{"bit":1}`, http.StatusOK},
+		{"BITCOUNT b", `{"count":1}`, http.StatusOK},
+		{"XLEN x", `{"length":1}`, http.StatusOK},
+		{"PFCOUNT p", `{"count":2}`, http.StatusOK},
+		{"JGET j a", `{"value":{"b":1}}`, http.StatusOK},
+		{"HGET missing f", `"Key not exist"`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if got, status := underReadLock(t, ds, tt.command); got != tt.want || status != tt.status {
+			t.Errorf("%s = %s, %d, want %s, %d", tt.command, got, status, tt.want, tt.status)
+		}
+	}
+	if _, status := underReadLock(t, ds, "QSTAT q"); status != http.StatusOK {
+		t.Errorf("QSTAT q = %d", status)
+	}
+	if got, status := underReadLock(t, ds, "XREAD x 0"); status != http.StatusOK || !strings.Contains(got, `"value":"e"`) {
+		t.Errorf("XREAD x 0 = %s, %d", got, status)
+	}
+	if got, status := underReadLock(t, ds, "XREAD x $"); got != `{"entries":[]}` || status != http.StatusOK {
+		t.Errorf("XREAD x $ = %s, %d", got, status)
+	}
+
+	// Expired sketches count as empty and are purged afterwards
+	runSteps(t, ds, []step{{"PFADD gone z", `{"updated":1}`, http.StatusOK}})
+	ds.mu.Lock()
+	ds.data["gone"].expiry = time.Now().Add(-time.Second)
+	ds.mu.Unlock()
+	runSteps(t, ds, []step{{"PFCOUNT p gone", `{"count":2}`, http.StatusOK}})
+	if _, ok := ds.data["gone"]; ok {
+		t.Error("expired sketch still stored after PFCOUNT")
+	}
+
+	// So do expired streams
+	expireNow(t, ds, "x")
+	runSteps(t, ds, []step{{"XREAD x 0", `{"entries":[]}`, http.StatusOK}})
+	if _, ok := ds.data["x"]; ok {
+		t.Error("expired stream still stored after XREAD")
+	}
+}
+
+// BenchmarkParallelGet measures GET throughput with many concurrent readers,
+// and the same reads made one at a time as they were under an exclusive lock
+func BenchmarkParallelGet(b *testing.B) {
+	ds := NewDatastore(Options{})
+	for i := 0; i < 1000; i++ {
+		ds.Set(fmt.Sprintf("key%d", i), "value", setOptions{})
+	}
+
+	b.Run("read lock", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				ds.Get(fmt.Sprintf("key%d", i%1000))
+			}
+		})
+	})
+	b.Run("exclusive", func(b *testing.B) {
+		var mu sync.Mutex
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				key := fmt.Sprintf("key%d", i%1000)
+				mu.Lock()
+				ds.Get(key)
+				mu.Unlock()
+			}
+		})
+	})
+}
+
+func TestPersist(t *testing.T) {
+	ds := NewDatastore(Options{})
+	runSteps(t, ds, []step{
+		{"SET k v EX100", `"Enter data sucessfull"`, http.StatusOK},
+		{"SET forever v", `"Enter data sucessfull"`, http.StatusOK},
+		{"PERSIST k", `{"removed":1}`, http.StatusOK},
+		{"TTL k", `{"ttl":-1}`, http.StatusOK},
+		{"PERSIST k", `{"removed":0}`, http.StatusOK},
+		{"PERSIST forever", `{"removed":0}`, http.StatusOK},
+		{"PERSIST missing", `{"removed":0}`, http.StatusOK},
+		{"PERSIST", `"Invalid Command"`, http.StatusBadRequest},
+	})
+}
+
+func TestQRange(t *testing.T) {
+	ds := NewDatastore(Options{})
+	runSteps(t, ds, []step{
+		{"QPUSH q a b c d", `"Value is pushed successfully"`, http.StatusOK},
+		{"SET s v", `"Enter data sucessfull"`, http.StatusOK},
+	})
+
+	tests := []struct {
+		command string
+		items   string
+		status  int
+	}{
+		{"QRANGE q 0 -1", `["a","b","c","d"]`, http.StatusOK},
+		{"QRANGE q 1 2", `["b","c"]`, http.StatusOK},
+		{"QRANGE q -2 -1", `["c","d"]`, http.StatusOK},
+		{"QRANGE q -100 100", `["a","b","c","d"]`, http.StatusOK},
+		{"QRANGE q 3 1", `[]`, http.StatusOK},
+		{"QRANGE q 10 20", `[]`, http.StatusOK},
+		{"QRANGE missing 0 -1", `[]`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		runSteps(t, ds, []step{{tt.command, `{"items":` + tt.items + `,"values":` + tt.items + `}`, tt.status}})
+	}
+
+	runSteps(t, ds, []step{
+		{"QRANGE s 0 -1", `"` + wrongTypeMessage + `"`, http.StatusConflict},
+		{"QRANGE q a 1", `"Invalid Command"`, http.StatusBadRequest},
+		{"QLEN q", `{"capacity":0,"length":4,"visible":4}`, http.StatusOK},
+	})
+}
+
+func TestHealthy(t *testing.T) {
+	ds := NewDatastore(Options{})
+	if !ds.Healthy(10 * time.Millisecond) {
+		t.Fatal("open datastore reported unhealthy")
+	}
+
+	ds.mu.Lock()
+	started := time.Now()
+	healthy := ds.Healthy(20 * time.Millisecond)
+	waited := time.Since(started)
+	ds.mu.Unlock()
+	if healthy {
+		t.Error("datastore reported healthy while the write lock was held")
+	}
+	if waited < 20*time.Millisecond || waited > time.Second {
+		t.Errorf("probe gave up after %v, want about 20ms", waited)
+	}
+
+	ds.Close()
+	if ds.Healthy(10 * time.Millisecond) {
+		t.Error("closed datastore reported healthy")
+	}
+}
+
+// expireNow makes key expire without removing it from the map, as if its TTL
+// had just run out and nothing had looked at it since
+func expireNow(t *testing.T, ds *Datastore, key string) {
+	t.Helper()
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	data, ok := ds.data[key]
+	if !ok {
+		t.Fatalf("%s is not stored", key)
+	}
+	data.expiry = time.Now().Add(-time.Second)
+}
+
+func TestDel(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		want    string
+	}{
+		{"mixed existing and missing keys", "DEL s missing q", `{"deleted":2}`},
+		{"only missing keys", "DEL missing other", `{"deleted":0}`},
+		{"a queue", "DEL q", `{"deleted":1}`},
+		{"a logically expired key", "DEL old", `{"deleted":1}`},
+		{"a key given twice", "DEL s s", `{"deleted":1}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := NewDatastore(Options{})
+			runSteps(t, ds, []step{
+				{"SET s v", `"Enter data sucessfull"`, http.StatusOK},
+				{"SET old v", `"Enter data sucessfull"`, http.StatusOK},
+				{"QPUSH q a b", `"Value is pushed successfully"`, http.StatusOK},
+			})
+			expireNow(t, ds, "old")
+
+			runSteps(t, ds, []step{{tt.command, tt.want, http.StatusOK}})
+			for _, key := range strings.Fields(tt.command)[1:] {
+				if _, ok := ds.data[key]; ok {
+					t.Errorf("%s still stored after %s", key, tt.command)
+				}
+			}
+		})
+	}
+
+	runSteps(t, NewDatastore(Options{}), []step{{"DEL", `"Invalid Command"`, http.StatusBadRequest}})
+}
+
+func TestQueuePopOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"QPOP is first in, first out", []step{
+			{"QPOP q", `{"value":"a"}`, http.StatusOK},
+			{"QPOP q", `{"value":"b"}`, http.StatusOK},
+			{"QPOP q", `{"value":"c"}`, http.StatusOK},
+			{"QPOP q", `{"error":"Q is empty so nothing can be popped!!"}`, http.StatusBadRequest},
+		}},
+		{"BACK pops the newest", []step{
+			{"QPOP q BACK", `{"value":"c"}`, http.StatusOK},
+			{"QPOP q FRONT", `{"value":"a"}`, http.StatusOK},
+			{"QPOP q back", `{"value":"b"}`, http.StatusOK},
+		}},
+		{"QPOPFRONT and QPOPBACK", []step{
+			{"QPOPBACK q", `{"value":"c"}`, http.StatusOK},
+			{"QPOPFRONT q", `{"value":"a"}`, http.StatusOK},
+		}},
+		{"interleaved pushes keep their order", []step{
+			{"QPOP q", `{"value":"a"}`, http.StatusOK},
+			{"QPUSH q d", `"Value is pushed successfully"`, http.StatusOK},
+			{"QPOP q", `{"value":"b"}`, http.StatusOK},
+			{"QPUSH q e", `"Value is pushed successfully"`, http.StatusOK},
+			{"QPOP q 5", `{"values":["c","d","e"]}`, http.StatusOK},
+		}},
+		{"BQPOP takes the same ends", []step{
+			{"BQPOP q 1", `{"key":"q","value":"a"}`, http.StatusOK},
+			{"BQPOP q 1 BACK", `{"key":"q","value":"c"}`, http.StatusOK},
+			{"BQPOP q 1 FRONT", `{"key":"q","value":"b"}`, http.StatusOK},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := NewDatastore(Options{})
+			runSteps(t, ds, []step{{"QPUSH q a b c", `"Value is pushed successfully"`, http.StatusOK}})
+			runSteps(t, ds, tt.steps)
+		})
+	}
+}
+
+// TestQueueFrontPopsReuseStorage pushes and pops one value at a time many
+// times over a queue that never empties, and checks its backing array does
+// not grow with the number popped
+func TestQueueFrontPopsReuseStorage(t *testing.T) {
+	ds := NewDatastore(Options{})
+	ds.QPush("q", time.Time{}, "first")
+	for i := 0; i < 10000; i++ {
+		ds.QPush("q", time.Time{}, "a")
+		ds.QPop("q", false)
+	}
+	if c := cap(ds.data["q"].queue); c > 1024 {
+		t.Errorf("queue holding %d values has capacity %d", len(ds.data["q"].queue), c)
+	}
+}
+
+func TestAppendAndStrLen(t *testing.T) {
+	wrongType := `{"error":"` + wrongTypeMessage + `"}`
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"APPEND creates a missing key", []step{
+			{"APPEND new hello", `{"length":5}`, http.StatusOK},
+			{"GET new", `{"value":"hello"}`, http.StatusOK},
+		}},
+		{"APPEND adds to an existing string", []step{
+			{"APPEND s world", `{"length":7}`, http.StatusOK},
+			{"GET s", `{"value":"hiworld"}`, http.StatusOK},
+			{"STRLEN s", `{"length":7}`, http.StatusOK},
+		}},
+		{"APPEND keeps the TTL", []step{
+			{"SET t v EX100", `"Enter data sucessfull"`, http.StatusOK},
+			{"APPEND t w", `{"length":2}`, http.StatusOK},
+			{"TTL t", `{"ttl":100}`, http.StatusOK},
+		}},
+		{"APPEND refuses a queue", []step{
+			{"APPEND q x", wrongType, http.StatusConflict},
+			{"QPOP q", `{"value":"a"}`, http.StatusOK},
+		}},
+		{"STRLEN counts bytes", []step{
+			{"SET u héllo", `"Enter data sucessfull"`, http.StatusOK},
+			{"STRLEN u", `{"length":6}`, http.StatusOK},
+		}},
+		{"STRLEN of a missing key", []step{{"STRLEN missing", `{"length":0}`, http.StatusNotFound}}},
+		{"STRLEN refuses a queue", []step{{"STRLEN q", wrongType, http.StatusConflict}}},
+		{"bad arguments", []step{
+			{"APPEND s", `"Invalid Command"`, http.StatusBadRequest},
+			{"STRLEN s t", `"Invalid Command"`, http.StatusBadRequest},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := NewDatastore(Options{})
+			runSteps(t, ds, []step{
+				{"SET s hi", `"Enter data sucessfull"`, http.StatusOK},
+				{"QPUSH q a", `"Value is pushed successfully"`, http.StatusOK},
+			})
+			runSteps(t, ds, tt.steps)
+		})
+	}
+}
+
+func TestExpiryReaperRemovesUnreadKeys(t *testing.T) {
+	for _, batch := range []int{0, 2} {
+		t.Run(fmt.Sprintf("batch %d", batch), func(t *testing.T) {
+			ds := NewDatastore(Options{})
+			defer ds.Close()
+			runSteps(t, ds, []step{
+				{"SET short v PX200", `"Enter data sucessfull"`, http.StatusOK},
+				{"SET long v EX100", `"Enter data sucessfull"`, http.StatusOK},
+				{"QPUSH q a", `"Value is pushed successfully"`, http.StatusOK},
+			})
+			for i := 0; i < 5; i++ {
+				runSteps(t, ds, []step{{fmt.Sprintf("SET other%d v PX200", i), `"Enter data sucessfull"`, http.StatusOK}})
+			}
+			ds.StartExpiryReaper(10*time.Millisecond, batch)
+
+			// Nothing reads the keys; only the reaper can remove them
+			waitFor(t, ds, func() bool { return len(ds.data) == 2 })
+			ds.mu.Lock()
+			defer ds.mu.Unlock()
+			for _, key := range []string{"long", "q"} {
+				if _, ok := ds.data[key]; !ok {
+					t.Errorf("reaper removed %s", key)
+				}
+			}
+		})
+	}
+}
+
+// TestShutdownReleasesBlockedCallers shuts a server down the way main does
+// on SIGINT or SIGTERM while a BQPOP with no timeout is in flight
+func TestShutdownReleasesBlockedCallers(t *testing.T) {
+	ds := NewDatastore(Options{})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, status := ds.HandleCommand(r.Context(), "BQPOP q 0")
+		w.WriteHeader(status)
+	})}
+	go server.Serve(listener)
+
+	statuses := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			statuses <- 0
+			return
+		}
+		resp.Body.Close()
+		statuses <- resp.StatusCode
+	}()
+	waitFor(t, ds, func() bool { return len(ds.waiters["q"]) == 1 })
+
+	started := time.Now()
+	ds.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownGracePeriod)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if took := time.Since(started); took > time.Second {
+		t.Errorf("shutdown took %v", took)
+	}
+	if status := <-statuses; status != http.StatusServiceUnavailable {
+		t.Errorf("blocked BQPOP answered %d, want %d", status, http.StatusServiceUnavailable)
+	}
+
+	// Later blocking calls return at once rather than hang
+	runSteps(t, ds, []step{{"BQPOP q 0", "null", http.StatusServiceUnavailable}})
+}
+
+func TestFlushAllAndDBSize(t *testing.T) {
+	runSteps(t, NewDatastore(Options{}), []step{
+		{"SET k v", `"Enter data sucessfull"`, http.StatusOK},
+		{"FLUSHALL", `"FLUSHALL is disabled"`, http.StatusForbidden},
+		{"DBSIZE", `{"keys":1}`, http.StatusOK},
+	})
+
+	ds := NewDatastore(Options{AllowFlush: true})
+	runSteps(t, ds, []step{
+		{"SET k v", `"Enter data sucessfull"`, http.StatusOK},
+		{"SET old v", `"Enter data sucessfull"`, http.StatusOK},
+		{"QPUSH q a", `"Value is pushed successfully"`, http.StatusOK},
+	})
+	expireNow(t, ds, "old")
+	runSteps(t, ds, []step{{"DBSIZE", `{"keys":2}`, http.StatusOK}})
+
+	// A blocked BQPOP is released by the flush rather than left hanging
+	blocked := async(t, ds, "BQPOP empty 0")
+	waitFor(t, ds, func() bool { return len(ds.waiters["empty"]) == 1 })
+	runSteps(t, ds, []step{
+		{"FLUSHALL", `"All keys are flushed"`, http.StatusOK},
+		{"DBSIZE", `{"keys":0}`, http.StatusOK},
+		{"EXISTS k q", `{"count":0}`, http.StatusOK},
+		{"FLUSHALL now", `"Invalid Command"`, http.StatusBadRequest},
+	})
+	select {
+	case got := <-blocked:
+		if got.status != http.StatusNotFound {
+			t.Errorf("BQPOP after FLUSHALL = %s, %d", got.want, got.status)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("BQPOP still blocked after FLUSHALL")
+	}
+
+	// The flush only releases callers blocked at the time
+	runSteps(t, ds, []step{{"SET k v", `"Enter data sucessfull"`, http.StatusOK}})
+	later := async(t, ds, "BQPOP q 0")
+	waitFor(t, ds, func() bool { return len(ds.waiters["q"]) == 1 })
+	runSteps(t, ds, []step{{"QPUSH q b", `"Value is pushed successfully"`, http.StatusOK}})
+	if got := <-later; got.want != `{"key":"q","value":"b"}` {
+		t.Errorf("BQPOP after the flush = %s, %d", got.want, got.status)
+	}
+}
+
+func TestSetKeepTTL(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"KEEPTTL carries the expiry over", []step{
+			{"SET k v2 KEEPTTL", `"Enter data sucessfull"`, http.StatusOK},
+			{"GET k", `{"value":"v2"}`, http.StatusOK},
+			{"TTL k", `{"ttl":5}`, http.StatusOK},
+		}},
+		{"a plain SET still clears it", []step{
+			{"SET k v2", `"Enter data sucessfull"`, http.StatusOK},
+			{"TTL k", `{"ttl":-1}`, http.StatusOK},
+		}},
+		{"KEEPTTL with a condition", []step{
+			{"SET k v2 XX KEEPTTL", `"Enter data sucessfull"`, http.StatusOK},
+			{"TTL k", `{"ttl":5}`, http.StatusOK},
+		}},
+		{"KEEPTTL on a missing key sets no expiry", []step{
+			{"SET new v KEEPTTL", `"Enter data sucessfull"`, http.StatusOK},
+			{"TTL new", `{"ttl":-1}`, http.StatusOK},
+		}},
+		{"GETSET KEEPTTL", []step{
+			{"GETSET k v2 KEEPTTL", `{"old":"v"}`, http.StatusOK},
+			{"TTL k", `{"ttl":5}`, http.StatusOK},
+		}},
+		{"KEEPTTL with an expiry is refused", []step{
+			{"SET k v2 KEEPTTL EX10", `{"error":"KEEPTTL cannot be combined with an expiry"}`, http.StatusBadRequest},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := NewDatastore(Options{})
+			runSteps(t, ds, []step{{"SET k v EX5", `"Enter data sucessfull"`, http.StatusOK}})
+			runSteps(t, ds, tt.steps)
+		})
+	}
+}
+
+func TestValidateSetInput(t *testing.T) {
+	ds := NewDatastore(Options{})
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"k", "v"}, true},
+		{[]string{"k", "v", "EX10"}, true},
+		{[]string{"k", "v", "EXabc"}, false},
+		{[]string{"k", "v", "EX-5"}, false},
+		{[]string{"k", "v", "EX10", "NX"}, true},
+		{[]string{"k"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := ds.ValidateSetInput(tt.args); got != tt.want {
+			t.Errorf("ValidateSetInput(%q) = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestSetRejectsMalformedExpiry(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"SET k v EX", `{"error":"missing number after EX"}`},
+		{"SET k v EXabc", `{"error":"EX value \"abc\" is not an integer"}`},
+		{"SET k v EX0", `{"error":"EX value must be positive"}`},
+		{"SET k v EX-5", `{"error":"EX value must be positive"}`},
+		{"SET k v PXabc", `{"error":"PX value \"abc\" is not an integer"}`},
+		{"SET k v EX 1.5", `{"error":"EX value \"1.5\" is not an integer"}`},
+		{"SET k v ex1x", `{"error":"EX value \"1x\" is not an integer"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			ds := NewDatastore(Options{})
+			runSteps(t, ds, []step{
+				{tt.command, tt.want, http.StatusBadRequest},
+				// Never stored without an expiry instead
+				{"EXISTS k", `{"count":0}`, http.StatusOK},
+			})
+		})
+	}
+}
+
+func TestSetRefusesToReplaceOtherTypes(t *testing.T) {
+	wrongType := `"` + wrongTypeMessage + `"`
+	ds := NewDatastore(Options{})
+	runSteps(t, ds, []step{
+		{"QPUSH jobs a b", `"Value is pushed successfully"`, http.StatusOK},
+		{"SET jobs oops", wrongType, http.StatusConflict},
+		{"QLEN jobs", `{"capacity":0,"length":2,"visible":2}`, http.StatusOK},
+		{"SET jobs oops FORCE", `"Enter data sucessfull"`, http.StatusOK},
+		{"GET jobs", `{"value":"oops"}`, http.StatusOK},
+		{"QLEN jobs", wrongType, http.StatusConflict},
+
+		{"HSET h f v", `{"added":1}`, http.StatusOK},
+		{"SET h v", wrongType, http.StatusConflict},
+		{"SET h v NX FORCE", `""`, http.StatusConflict},
+		{"SET h v FORCE FORCE", `{"error":"FORCE given more than once"}`, http.StatusBadRequest},
+	})
+
+	// An expired queue is as good as missing
+	runSteps(t, ds, []step{{"QPUSH old a", `"Value is pushed successfully"`, http.StatusOK}})
+	expireNow(t, ds, "old")
+	runSteps(t, ds, []step{{"SET old v", `"Enter data sucessfull"`, http.StatusOK}})
+}
+
+func TestAccessRemovesExpiredKeys(t *testing.T) {
+	tests := []struct {
+		step
+		removes bool // Whether k is left missing rather than rewritten
+	}{
+		{step{"GET k", `{"error":"key does not exist"}`, http.StatusNotFound}, true},
+		{step{"EXISTS k", `{"count":0}`, http.StatusOK}, true},
+		{step{"TTL k", `{"ttl":-2}`, http.StatusNotFound}, true},
+		{step{"STRLEN k", `{"length":0}`, http.StatusNotFound}, true},
+		{step{"TYPE k", `{"type":"none"}`, http.StatusNotFound}, true},
+		// Writes see no ghost of the old value
+		{step{"SET k v2 NX", `"Enter data sucessfull"`, http.StatusOK}, false},
+		{step{"QPUSH k a", `"Value is pushed successfully"`, http.StatusOK}, false},
+		{step{"INCR k", `{"value":1}`, http.StatusOK}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			ds := NewDatastore(Options{})
+			runSteps(t, ds, []step{{"SET k v PX20", `"Enter data sucessfull"`, http.StatusOK}})
+			time.Sleep(30 * time.Millisecond)
+
+			runSteps(t, ds, []step{tt.step})
+			if _, ok := ds.data["k"]; ok == tt.removes {
+				t.Errorf("after %s, k stored = %v", tt.command, ok)
+			}
+		})
+	}
+}
+
+func TestBQPopWakesAsSoonAsAValueIsPushed(t *testing.T) {
+	ds := NewDatastore(Options{})
+	blocked := async(t, ds, "BQPOP q 5")
+	waitFor(t, ds, func() bool { return len(ds.waiters["q"]) == 1 })
+
+	pushed := time.Now()
+	runSteps(t, ds, []step{{"QPUSH q a", `"Value is pushed successfully"`, http.StatusOK}})
+	got := <-blocked
+	if waited := time.Since(pushed); waited > 50*time.Millisecond {
+		t.Errorf("BQPOP returned %v after the push", waited)
+	}
+	if got.want != `{"key":"q","value":"a"}` || got.status != http.StatusOK {
+		t.Errorf("BQPOP q 5 = %s, %d", got.want, got.status)
+	}
+}
+
+func TestBQPopTimesOut(t *testing.T) {
+	ds := NewDatastore(Options{})
+	started := time.Now()
+	runSteps(t, ds, []step{{"BQPOP q 0.1", "null", http.StatusNotFound}})
+	if waited := time.Since(started); waited < 100*time.Millisecond || waited > time.Second {
+		t.Errorf("BQPOP q 0.1 returned after %v", waited)
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if len(ds.waiters) != 0 {
+		t.Errorf("timed out waiter still registered: %v", ds.waiters)
+	}
+}
+
+func TestQPushFront(t *testing.T) {
+	ds := NewDatastore(Options{})
+	runSteps(t, ds, []step{
+		{"QPUSH q a b c", `"Value is pushed successfully"`, http.StatusOK},
+		{"QPOP q", `{"value":"a"}`, http.StatusOK},
+		// Retried, so it is next
+		{"QPUSHFRONT q a", `"Value is pushed successfully"`, http.StatusOK},
+		{"QPOP q", `{"value":"a"}`, http.StatusOK},
+		// Several keep the order given
+		{"QPUSHFRONT q x y", `"Value is pushed successfully"`, http.StatusOK},
+		{"QRANGE q 0 -1", `{"items":["x","y","b","c"],"values":["x","y","b","c"]}`, http.StatusOK},
+		{"QPUSHFRONT new v", `"Value is pushed successfully"`, http.StatusOK},
+		{"QPOP new", `{"value":"v"}`, http.StatusOK},
+		{"SET s v", `"Enter data sucessfull"`, http.StatusOK},
+		{"QPUSHFRONT s v", `"` + wrongTypeMessage + `"`, http.StatusConflict},
+		{"QPUSHFRONT q", "null", http.StatusBadRequest},
+	})
+
+	blocked := async(t, ds, "BQPOP empty 5")
+	waitFor(t, ds, func() bool { return len(ds.waiters["empty"]) == 1 })
+	runSteps(t, ds, []step{{"QPUSHFRONT empty v", `"Value is pushed successfully"`, http.StatusOK}})
+	if got := <-blocked; got.want != `{"key":"empty","value":"v"}` {
+		t.Errorf("BQPOP woken by QPUSHFRONT = %s, %d", got.want, got.status)
+	}
+}
+
+func TestQRem(t *testing.T) {
+	tests := []struct {
+		command string
+		removed string
+		left    string
+	}{
+		{"QREM q 1 a", `{"removed":1}`, `["b","a","c","a"]`},
+		{"QREM q 2 a", `{"removed":2}`, `["b","c","a"]`},
+		{"QREM q -1 a", `{"removed":1}`, `["a","b","a","c"]`},
+		{"QREM q -2 a", `{"removed":2}`, `["a","b","c"]`},
+		{"QREM q 0 a", `{"removed":3}`, `["b","c"]`},
+		{"QREM q 10 a", `{"removed":3}`, `["b","c"]`},
+		{"QREM q 0 z", `{"removed":0}`, `["a","b","a","c","a"]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			ds := NewDatastore(Options{})
+			runSteps(t, ds, []step{
+				{"QPUSH q a b a c a", `"Value is pushed successfully"`, http.StatusOK},
+				{tt.command, tt.removed, http.StatusOK},
+				{"QRANGE q 0 -1", `{"items":` + tt.left + `,"values":` + tt.left + `}`, http.StatusOK},
+			})
+		})
+	}
+
+	runSteps(t, NewDatastore(Options{}), []step{
+		{"QREM missing 0 a", `{"removed":0}`, http.StatusOK},
+		{"SET s v", `"Enter data sucessfull"`, http.StatusOK},
+		{"QREM s 0 a", `"` + wrongTypeMessage + `"`, http.StatusConflict},
+		{"QREM q x a", `"Invalid Command"`, http.StatusBadRequest},
+	})
+}
+
+func TestParseCommandToleratesIrregularSpacing(t *testing.T) {
+	ds := NewDatastore(Options{})
+	for _, raw := range []string{
+		"SET  key  value",
+		"  SET key value",
+		"SET key value   ",
+		"SET\tkey\t\tvalue",
+		"set key \n value",
+	} {
+		command, args, err := ds.ParseCommand(raw)
+		if err != nil || command != "SET" || !reflect.DeepEqual(args, []string{"key", "value"}) {
+			t.Errorf("ParseCommand(%q) = %q, %q, %v", raw, command, args, err)
+		}
+	}
+
+	runSteps(t, ds, []step{
+		{"SET  key   value  EX10", `"Enter data sucessfull"`, http.StatusOK},
+		{"  GET key ", `{"value":"value"}`, http.StatusOK},
+	})
+}
+
+func TestBQPopZeroTimeoutWaitsForAValue(t *testing.T) {
+	ds := NewDatastore(Options{})
+	blocked := async(t, ds, "BQPOP q 0")
+
+	// Delivered well after a zero timeout used to give up
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		ds.QPush("q", time.Time{}, "late")
+	}()
+
+	select {
+	case got := <-blocked:
+		if got.want != `{"key":"q","value":"late"}` || got.status != http.StatusOK {
+			t.Errorf("BQPOP q 0 = %s, %d", got.want, got.status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("BQPOP q 0 never received the pushed value")
+	}
+
+	runSteps(t, ds, []step{
+		{"BQPOP q -1", "null", http.StatusBadRequest},
+		{"BQPOP q soon", "null", http.StatusBadRequest},
+	})
+}
+
+func TestBQPopZeroTimeoutStopsWhenTheCallerGoesAway(t *testing.T) {
+	ds := NewDatastore(Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	returned := make(chan int, 1)
+	go func() {
+		_, status := ds.HandleCommand(ctx, "BQPOP q 0")
+		returned <- status
+	}()
+	waitFor(t, ds, func() bool { return len(ds.waiters["q"]) == 1 })
+
+	cancel()
+	select {
+	case status := <-returned:
+		if status != http.StatusRequestTimeout {
+			t.Errorf("cancelled BQPOP q 0 = %d, want %d", status, http.StatusRequestTimeout)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("BQPOP q 0 still waiting after its context was cancelled")
+	}
+}
+
+func TestParseBlockTimeout(t *testing.T) {
+	tests := []struct {
+		s    string
+		want float64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"0.3", 0.3, true},
+		{"1.5", 1.5, true},
+		{"-1", 0, false},
+		{"NaN", 0, false},
+		{"+Inf", 0, false},
+		{"soon", 0, false},
+		// Rounds to 2^63 nanoseconds, which would wrap around to negative
+		{"9223372036.854775807", 0, false},
+		{"9223372036", 9223372036, true},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseBlockTimeout(tt.s)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseBlockTimeout(%q) = %v, %v, want %v, %v", tt.s, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestBQPopFractionalTimeouts(t *testing.T) {
+	tests := []struct {
+		timeout    string
+		maxTimeout time.Duration
+		want       time.Duration
+	}{
+		{"0.3", 0, 300 * time.Millisecond},
+		{"1.5", 0, 1500 * time.Millisecond},
+		{"0.001", 0, time.Millisecond},
+		{"60", 200 * time.Millisecond, 200 * time.Millisecond},
+		{"0", 200 * time.Millisecond, 200 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s capped at %v", tt.timeout, tt.maxTimeout), func(t *testing.T) {
+			t.Parallel()
+			ds := NewDatastore(Options{MaxBlockTimeout: tt.maxTimeout})
+			started := time.Now()
+			runSteps(t, ds, []step{{"BQPOP q " + tt.timeout, "null", http.StatusNotFound}})
+			if waited := time.Since(started); waited < tt.want || waited > tt.want+250*time.Millisecond {
+				t.Errorf("waited %v, want about %v", waited, tt.want)
+			}
+		})
+	}
+}
+
+func TestBQPopServesWaitersInArrivalOrder(t *testing.T) {
+	ds := NewDatastore(Options{})
+	var waiting []<-chan step
+	for i := 1; i <= 3; i++ {
+		waiting = append(waiting, async(t, ds, "BQPOP q 5"))
+		waitFor(t, ds, func() bool { return len(ds.waiters["q"]) == i })
+	}
+
+	for i, value := range []string{"a", "b", "c"} {
+		runSteps(t, ds, []step{{"QPUSH q " + value, `"Value is pushed successfully"`, http.StatusOK}})
+		if got := <-waiting[i]; got.want != `{"key":"q","value":"`+value+`"}` {
+			t.Errorf("waiter %d got %s, %d, want %s", i+1, got.want, got.status, value)
+		}
+	}
+}
+
+func TestBQPopWaitersThatGaveUpTakeNothing(t *testing.T) {
+	ds := NewDatastore(Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan int, 1)
+	go func() {
+		_, status := ds.HandleCommand(ctx, "BQPOP q 5")
+		cancelled <- status
+	}()
+	waitFor(t, ds, func() bool { return len(ds.waiters["q"]) == 1 })
+	timedOut := async(t, ds, "BQPOP q 0.05")
+	waitFor(t, ds, func() bool { return len(ds.waiters["q"]) == 2 })
+	live := async(t, ds, "BQPOP q 5")
+	waitFor(t, ds, func() bool { return len(ds.waiters["q"]) == 3 })
+
+	cancel()
+	if status := <-cancelled; status != http.StatusRequestTimeout {
+		t.Errorf("cancelled waiter = %d", status)
+	}
+	if got := <-timedOut; got.status != http.StatusNotFound {
+		t.Errorf("timed out waiter = %s, %d", got.want, got.status)
+	}
+
+	runSteps(t, ds, []step{{"QPUSH q a", `"Value is pushed successfully"`, http.StatusOK}})
+	if got := <-live; got.want != `{"key":"q","value":"a"}` {
+		t.Errorf("remaining waiter = %s, %d", got.want, got.status)
+	}
+}
+
+func TestBlockingCommandsReturnWhenTheContextIsCancelled(t *testing.T) {
+	tests := []struct {
+		name string
+		call func(ctx context.Context, ds *Datastore) int
+	}{
+		{"BQPop", func(ctx context.Context, ds *Datastore) int {
+			_, _, status := ds.BQPop(ctx, []string{"q"}, 10, false)
+			return status
+		}},
+		{"BQPush", func(ctx context.Context, ds *Datastore) int {
+			_, status := ds.BQPush(ctx, "full", 10, "x")
+			return status
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := NewDatastore(Options{})
+			runSteps(t, ds, []step{
+				{"QCAP full 1", `"OK"`, http.StatusOK},
+				{"QPUSH full a", `"Value is pushed successfully"`, http.StatusOK},
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			returned := make(chan int, 1)
+			go func() { returned <- tt.call(ctx, ds) }()
+			waitFor(t, ds, func() bool { return len(ds.waiters["q"])+len(ds.pushers["full"]) == 1 })
+
+			cancelled := time.Now()
+			cancel()
+			select {
+			case status := <-returned:
+				if status != http.StatusRequestTimeout {
+					t.Errorf("status = %d, want %d", status, http.StatusRequestTimeout)
+				}
+				if took := time.Since(cancelled); took > 100*time.Millisecond {
+					t.Errorf("returned %v after the cancel", took)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("still blocked after the context was cancelled")
+			}
+
+			// Nothing is left registered to swallow a later value
+			ds.mu.Lock()
+			defer ds.mu.Unlock()
+			if len(ds.waiters)+len(ds.pushers) != 0 {
+				t.Errorf("left waiters %v and pushers %v", ds.waiters, ds.pushers)
+			}
+		})
+	}
+}
+
+func TestGetRemovesExpiredKeysFromTheMap(t *testing.T) {
+	tests := []step{
+		{"GET k", `{"error":"key does not exist"}`, http.StatusNotFound},
+		{"MGET k other", `{"values":[null,"v"]}`, http.StatusOK},
+		{"GETDEL k", `"Key not exist"`, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			ds := NewDatastore(Options{MaxBytes: 1 << 20})
+			runSteps(t, ds, []step{
+				{"SET k v PX20", `"Enter data sucessfull"`, http.StatusOK},
+				{"SET other v", `"Enter data sucessfull"`, http.StatusOK},
+			})
+			time.Sleep(30 * time.Millisecond)
+
+			runSteps(t, ds, []step{tt})
+
+			ds.mu.Lock()
+			defer ds.mu.Unlock()
+			ds.updateUsedBytes()
+			if _, ok := ds.data["k"]; ok {
+				t.Errorf("k is still stored after %s", tt.command)
+			}
+			if _, ok := ds.data["other"]; !ok {
+				t.Errorf("other was removed by %s", tt.command)
+			}
+			if want := ds.data["other"].approxSize("other"); ds.usedBytes != want {
+				t.Errorf("usedBytes = %d, want %d for other alone", ds.usedBytes, want)
+			}
+		})
+	}
+}
+
+func TestSetPXExpiresWithMillisecondResolution(t *testing.T) {
+	for _, command := range []string{"SET k v PX500", "SET k v PX 500", "SET k v px500"} {
+		t.Run(command, func(t *testing.T) {
+			t.Parallel()
+			ds := NewDatastore(Options{})
+			runSteps(t, ds, []step{{command, `"Enter data sucessfull"`, http.StatusOK}})
+
+			time.Sleep(200 * time.Millisecond)
+			runSteps(t, ds, []step{{"GET k", `{"value":"v"}`, http.StatusOK}})
+			if got, _ := do(t, ds, "PTTL k"); got == `{"pttl":-1}` || got == `{"pttl":-2}` {
+				t.Errorf("PTTL k at 200ms = %s, want time left", got)
+			}
+
+			time.Sleep(500 * time.Millisecond)
+			runSteps(t, ds, []step{{"GET k", `{"error":"key does not exist"}`, http.StatusNotFound}})
+		})
+	}
+}
+
+func TestMaxValueBytes(t *testing.T) {
+	const limit = 8
+	atLimit, overLimit := strings.Repeat("a", limit), strings.Repeat("a", limit+1)
+	tooLarge := `"` + valueTooLargeMessage + `"`
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"SET", []step{
+			{"SET k " + atLimit, `"Enter data sucessfull"`, http.StatusOK},
+			{"SET k " + overLimit, tooLarge, http.StatusRequestEntityTooLarge},
+			{"GET k", `{"value":"` + atLimit + `"}`, http.StatusOK},
+		}},
+		{"MSET", []step{
+			{"MSET a b k " + overLimit, tooLarge, http.StatusRequestEntityTooLarge},
+			{"EXISTS a k", `{"count":0}`, http.StatusOK},
+			{"MSET a b k " + atLimit, `"Enter data sucessfull"`, http.StatusOK},
+		}},
+		{"GETSET", []step{
+			{"SET k v", `"Enter data sucessfull"`, http.StatusOK},
+			{"GETSET k " + overLimit, tooLarge, http.StatusRequestEntityTooLarge},
+			{"GETSET k " + atLimit, `{"old":"v"}`, http.StatusOK},
+		}},
+		{"APPEND", []step{
+			{"SET k aaaa", `"Enter data sucessfull"`, http.StatusOK},
+			{"APPEND k aaaa", `{"length":8}`, http.StatusOK},
+			{"APPEND k a", `{"error":"` + valueTooLargeMessage + `"}`, http.StatusRequestEntityTooLarge},
+			{"STRLEN k", `{"length":8}`, http.StatusOK},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runSteps(t, NewDatastore(Options{MaxValueBytes: limit}), tt.steps)
+		})
+	}
+}
+
+func TestDecodeJSONBodyCapsTheBody(t *testing.T) {
+	body := `{"command":"GET k"}`
+	limit := int64(len(body))
+
+	tests := []struct {
+		name   string
+		body   string
+		status int // Written for a body that is refused, 200 otherwise
+	}{
+		{"at the limit", body, http.StatusOK},
+		{"just over the limit", `{"command":"GET kk"}`, http.StatusRequestEntityTooLarge},
+		{"far over the limit", `{"command":"SET k ` + strings.Repeat("a", 1<<20) + `"}`, http.StatusRequestEntityTooLarge},
+		{"not JSON", "{", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/command/", strings.NewReader(tt.body))
+			var v struct {
+				Command string `json:"command"`
+			}
+			if ok := decodeJSONBody(w, r, limit, &v); ok != (tt.status == http.StatusOK) {
+				t.Fatalf("decodeJSONBody = %v, want %v", ok, tt.status == http.StatusOK)
+			}
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestSetKeepTTLKeepsCountingDown(t *testing.T) {
+	ds := NewDatastore(Options{})
+	runSteps(t, ds, []step{{"SET k v PX300", `"Enter data sucessfull"`, http.StatusOK}})
+	time.Sleep(100 * time.Millisecond)
+
+	runSteps(t, ds, []step{{"SET k v2 KEEPTTL", `"Enter data sucessfull"`, http.StatusOK}})
+	got, _ := do(t, ds, "PTTL k")
+	var pttl struct{ PTTL int64 }
+	if err := json.Unmarshal([]byte(got), &pttl); err != nil {
+		t.Fatalf("PTTL k = %s: %v", got, err)
+	}
+	if pttl.PTTL <= 0 || pttl.PTTL > 200 {
+		t.Errorf("PTTL k after KEEPTTL = %d, want what was left of the first 300ms", pttl.PTTL)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	runSteps(t, ds, []step{{"GET k", `{"error":"key does not exist"}`, http.StatusNotFound}})
+}
+
+// BenchmarkMSet compares setting 100 keys with one MSET against 100 SETs,
+// each operation being the whole batch of 100
+func BenchmarkMSet(b *testing.B) {
+	const pairs = 100
+	ctx := context.Background()
+	sets := make([]string, pairs)
+	mset := []string{"MSET"}
+	for i := range sets {
+		sets[i] = fmt.Sprintf("SET key%d value%d", i, i)
+		mset = append(mset, fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+	msetCommand := strings.Join(mset, " ")
+
+	b.Run("MSET", func(b *testing.B) {
+		ds := NewDatastore(Options{})
+		for i := 0; i < b.N; i++ {
+			ds.HandleCommand(ctx, msetCommand)
+		}
+	})
+	b.Run("SET", func(b *testing.B) {
+		ds := NewDatastore(Options{})
+		for i := 0; i < b.N; i++ {
+			for _, command := range sets {
+				ds.HandleCommand(ctx, command)
+			}
+		}
+	})
+}
+
+func TestBQPopCompetingWaitersTakeOneValueEach(t *testing.T) {
+	ds := NewDatastore(Options{})
+	results := make(chan step, 5)
+	for i := 0; i < 5; i++ {
+		go func() { results <- <-async(t, ds, "BQPOP q 5") }()
+	}
+	waitFor(t, ds, func() bool { return len(ds.waiters["q"]) == 5 })
+
+	runSteps(t, ds, []step{{"QPUSH q a", `"Value is pushed successfully"`, http.StatusOK}})
+	if got := <-results; got.want != `{"key":"q","value":"a"}` {
+		t.Fatalf("first waiter served = %s, %d", got.want, got.status)
+	}
+	select {
+	case got := <-results:
+		t.Fatalf("a second waiter returned %s, %d for one value", got.want, got.status)
+	case <-time.After(50 * time.Millisecond):
+	}
+	waitFor(t, ds, func() bool { return len(ds.waiters["q"]) == 4 })
+
+	runSteps(t, ds, []step{{"QPUSH q b c d e", `"Value is pushed successfully"`, http.StatusOK}})
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		got := <-results
+		if got.status != http.StatusOK || seen[got.want] {
+			t.Errorf("waiter served = %s, %d", got.want, got.status)
+		}
+		seen[got.want] = true
+	}
+	runSteps(t, ds, []step{{"QLEN q", `{"capacity":0,"length":0,"visible":0}`, http.StatusOK}})
+}
+
+func TestBQPopWaitersAcrossDeleteAndFlush(t *testing.T) {
+	tests := []struct {
+		command string
+		want    step // What the waiter gets, once a value is pushed if still waiting
+	}{
+		{"DEL q", step{"BQPOP q 5", `{"key":"q","value":"after"}`, http.StatusOK}},
+		{"DEL other", step{"BQPOP q 5", `{"key":"q","value":"after"}`, http.StatusOK}},
+		{"FLUSHALL", step{"BQPOP q 5", "null", http.StatusNotFound}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			ds := NewDatastore(Options{AllowFlush: true})
+			runSteps(t, ds, []step{
+				{"QPUSH q a", `"Value is pushed successfully"`, http.StatusOK},
+				{"QPOP q", `{"value":"a"}`, http.StatusOK},
+				{"SET other v", `"Enter data sucessfull"`, http.StatusOK},
+			})
+			waiting := async(t, ds, "BQPOP q 5")
+			waitFor(t, ds, func() bool { return len(ds.waiters["q"]) == 1 })
+
+			do(t, ds, tt.command)
+			do(t, ds, "QPUSH q after")
+
+			if got := <-waiting; got != tt.want {
+				t.Errorf("waiter got %s, %d, want %s, %d", got.want, got.status, tt.want.want, tt.want.status)
+			}
+			ds.mu.Lock()
+			defer ds.mu.Unlock()
+			if n := len(ds.waiters["q"]); n != 0 {
+				t.Errorf("%d waiters left on q", n)
+			}
+		})
+	}
+}
+
+// BenchmarkBQPopWakeLatency measures the time from a push to a blocked BQPOP
+// caller having the value, against the 100ms polling loop BQPOP used to run,
+// as ns/wake. Each push is made once the consumer is waiting, so polling
+// shows its worst case.
+func BenchmarkBQPopWakeLatency(b *testing.B) {
+	var misses int32 // Empty polls made by the polling consumer
+	consumers := []struct {
+		name    string
+		pop     func(ds *Datastore) string
+		waiting func(ds *Datastore) bool
+	}{
+		{
+			"wakeup",
+			func(ds *Datastore) string {
+				_, value, _ := ds.BQPop(context.Background(), []string{"q"}, 5, false)
+				return value
+			},
+			func(ds *Datastore) bool {
+				ds.mu.RLock()
+				defer ds.mu.RUnlock()
+				return len(ds.waiters["q"]) > 0
+			},
+		},
+		{
+			"poll every 100ms",
+			func(ds *Datastore) string {
+				for {
+					if value, status := ds.QPop("q", false); status == http.StatusOK {
+						return value
+					}
+					atomic.AddInt32(&misses, 1)
+					time.Sleep(100 * time.Millisecond)
+				}
+			},
+			func(ds *Datastore) bool { return atomic.LoadInt32(&misses) > 0 },
+		},
+	}
+
+	for _, consumer := range consumers {
+		b.Run(consumer.name, func(b *testing.B) {
+			ds := NewDatastore(Options{})
+			var latency time.Duration
+			for i := 0; i < b.N; i++ {
+				atomic.StoreInt32(&misses, 0)
+				got := make(chan string, 1)
+				go func() { got <- consumer.pop(ds) }()
+				for !consumer.waiting(ds) {
+					runtime.Gosched()
+				}
+
+				pushed := time.Now()
+				ds.QPush("q", time.Time{}, "v")
+				<-got
+				latency += time.Since(pushed)
+			}
+			b.ReportMetric(float64(latency.Nanoseconds())/float64(b.N), "ns/wake")
+		})
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+		bad           bool // Whether the pattern is malformed
+	}{
+		{"*", "", true, false},
+		{"user:*", "user:1", true, false},
+		{"user:*", "order:1", false, false},
+		{"*:1", "user/a:1", true, false}, // '/' is an ordinary character
+		{"user:?", "user:12", false, false},
+		{"user:??", "user:12", true, false},
+		{"[abc]*", "beta", true, false},
+		{"[^abc]*", "beta", false, false},
+		{"[!abc]*", "delta", true, false},
+		{"k[0-9]", "k7", true, false},
+		{"k[0-9]", "kx", false, false},
+		{"[*]", "*", true, false},
+		{`a\*b`, "a*b", true, false},
+		{`a\*b`, "axb", false, false},
+		{"*a*b", "xaxb", true, false},
+		{"*a*b", "xaxbx", false, false},
+		{"a*b*c", "abcbc", true, false},
+		{"[", "", false, true},
+		{"[]", "x", false, true},
+		{`a\`, "a", false, true},
+		{"x*[", "y", false, true}, // Malformed past the point of failing
+	}
+
+	for _, tt := range tests {
+		got, err := matchGlob(tt.pattern, tt.name)
+		if got != tt.want || (err != nil) != tt.bad {
+			t.Errorf("matchGlob(%q, %q) = %v, %v, want %v, bad pattern %v", tt.pattern, tt.name, got, err, tt.want, tt.bad)
+		}
+	}
+}
+
+// TestMatchGlobTakesLinearTime runs a pattern that makes a naive
+// backtracking matcher try every way of placing its stars
+func TestMatchGlobTakesLinearTime(t *testing.T) {
+	pattern, name := strings.Repeat("*a", 20)+"*b", strings.Repeat("a", 1000)
+
+	started := time.Now()
+	if matched, _ := matchGlob(pattern, name); matched {
+		t.Fatalf("%q matched %q", pattern, name)
+	}
+	if took := time.Since(started); took > 100*time.Millisecond {
+		t.Errorf("matching took %v", took)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		step
+	}{
+		{"string and queue keys", 0, step{"KEYS user:*", `{"keys":["user:1","user:2","user:q"],"truncated":false}`, http.StatusOK}},
+		{"queue keys only", 0, step{"KEYS *:q", `{"keys":["order:q","user:q"],"truncated":false}`, http.StatusOK}},
+		{"expired keys are left out", 0, step{"KEYS old*", `{"keys":[],"truncated":false}`, http.StatusOK}},
+		{"everything", 0, step{"KEYS *", `{"keys":["order:q","user:1","user:2","user:q"],"truncated":false}`, http.StatusOK}},
+		{"under the limit", 4, step{"KEYS user:*", `{"keys":["user:1","user:2","user:q"],"truncated":false}`, http.StatusOK}},
+		{"at the limit", 3, step{"KEYS user:*", `{"keys":["user:1","user:2","user:q"],"truncated":false}`, http.StatusOK}},
+		{"malformed pattern", 0, step{"KEYS user:[", `"Invalid Command"`, http.StatusBadRequest}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := NewDatastore(Options{KeysLimit: tt.limit})
+			runSteps(t, ds, []step{
+				{"SET user:1 a", `"Enter data sucessfull"`, http.StatusOK},
+				{"SET user:2 b", `"Enter data sucessfull"`, http.StatusOK},
+				{"QPUSH user:q x", `"Value is pushed successfully"`, http.StatusOK},
+				{"QPUSH order:q y", `"Value is pushed successfully"`, http.StatusOK},
+				{"SET old v", `"Enter data sucessfull"`, http.StatusOK},
+			})
+			expireNow(t, ds, "old")
+
+			runSteps(t, ds, []step{tt.step})
+		})
+	}
+
+	// Which keys make the cut over the limit depends on map order
+	t.Run("over the limit", func(t *testing.T) {
+		ds := NewDatastore(Options{KeysLimit: 2})
+		do(t, ds, "MSET user:1 a user:2 b user:3 c")
+		keys, truncated, _ := ds.Keys("user:*")
+		if len(keys) != 2 || !truncated {
+			t.Errorf("KEYS user:* = %q, truncated %v, want 2 keys, truncated", keys, truncated)
+		}
+	})
+}
+
+func TestQPushDelayOption(t *testing.T) {
+	const badDelay = `"DELAY needs a non-negative number of seconds followed by values"`
+	tests := []struct {
+		command string
+		want    string
+		status  int
+		length  string // QLEN q afterwards
+	}{
+		{"QPUSH q DELAY 60 a b", `"Value is pushed successfully"`, http.StatusOK, `{"capacity":0,"length":2,"visible":0}`},
+		{"QPUSH q DELAY 0 a", `"Value is pushed successfully"`, http.StatusOK, `{"capacity":0,"length":1,"visible":1}`},
+		{"QPUSH q EX60 DELAY 60 a", `"Value is pushed successfully"`, http.StatusOK, `{"capacity":0,"length":1,"visible":0}`},
+		{"QPUSH q delay 5 a", `"Value is pushed successfully"`, http.StatusOK, `{"capacity":0,"length":3,"visible":3}`},
+		{"QPUSH q a DELAY 5", `"Value is pushed successfully"`, http.StatusOK, `{"capacity":0,"length":3,"visible":3}`},
+		{"QPUSH q DELAY abc x", badDelay, http.StatusBadRequest, `{"capacity":0,"length":0,"visible":0}`},
+		{"QPUSH q DELAY -5 x", badDelay, http.StatusBadRequest, `{"capacity":0,"length":0,"visible":0}`},
+		{"QPUSH q DELAY 5", badDelay, http.StatusBadRequest, `{"capacity":0,"length":0,"visible":0}`},
+		{"QPUSH q DELAY", badDelay, http.StatusBadRequest, `{"capacity":0,"length":0,"visible":0}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			ds := NewDatastore(Options{})
+			runSteps(t, ds, []step{
+				{tt.command, tt.want, tt.status},
+				{"QLEN q", tt.length, http.StatusOK},
+			})
+		})
+	}
+}
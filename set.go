@@ -0,0 +1,278 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+)
+
+// SAdd adds members to the set at key, creating it if missing, and returns
+// how many were not already there. The set keeps any TTL it already has.
+func (ds *Datastore) SAdd(key string, members ...string) (int, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if !ok {
+		data = &Data{isSet: true, set: map[string]struct{}{}}
+	} else if !data.isSet {
+		return 0, http.StatusConflict
+	}
+
+	size := func() int {
+		size := data.approxSize(key)
+		for _, member := range members {
+			size += setMemberOverheadBytes + len(member)
+		}
+		return size
+	}
+	if !ds.makeRoom(key, size) {
+		return 0, http.StatusInsufficientStorage
+	}
+	if !ok {
+		ds.put(key, data)
+	}
+
+	added := 0
+	for _, member := range members {
+		if _, exists := data.set[member]; !exists {
+			data.set[member] = struct{}{}
+			added++
+		}
+	}
+
+	return added, http.StatusOK
+}
+
+// SRem removes members from the set at key and returns how many were there.
+// The key is deleted along with its last member.
+func (ds *Datastore) SRem(key string, members ...string) (int, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if !ok {
+		return 0, http.StatusOK
+	}
+	if !data.isSet {
+		return 0, http.StatusConflict
+	}
+
+	removed := 0
+	for _, member := range members {
+		if _, exists := data.set[member]; exists {
+			delete(data.set, member)
+			removed++
+		}
+	}
+	if len(data.set) == 0 {
+		ds.remove(key)
+	}
+
+	return removed, http.StatusOK
+}
+
+// SIsMember reports whether member is in the set at key. A missing key is an
+// empty set.
+func (ds *Datastore) SIsMember(key, member string) (bool, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return false, http.StatusOK
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return false, http.StatusOK
+	}
+	if !data.isSet {
+		return false, http.StatusConflict
+	}
+	data.touch()
+
+	_, exists := data.set[member]
+	return exists, http.StatusOK
+}
+
+// SMembers returns the members of the set at key in sorted order, so the
+// result is the same from call to call. A missing key gives an empty set.
+func (ds *Datastore) SMembers(key string) ([]string, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return []string{}, http.StatusOK
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return []string{}, http.StatusOK
+	}
+	if !data.isSet {
+		return nil, http.StatusConflict
+	}
+	data.touch()
+
+	return data.sortedMembers(), http.StatusOK
+}
+
+// SCard returns the number of members in the set at key, 0 if the key is
+// missing
+func (ds *Datastore) SCard(key string) (int, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return 0, http.StatusOK
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return 0, http.StatusOK
+	}
+	if !data.isSet {
+		return 0, http.StatusConflict
+	}
+
+	return len(data.set), http.StatusOK
+}
+
+// sortedMembers returns the members of the set in sorted order
+func (d *Data) sortedMembers() []string {
+	members := make([]string, 0, len(d.set))
+	for member := range d.set {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// Set operations for SINTER, SUNION and SDIFF and their STORE forms
+const (
+	setInter = "SINTER"
+	setUnion = "SUNION"
+	setDiff  = "SDIFF"
+)
+
+// SInter returns the members found in every one of the sets at keys
+func (ds *Datastore) SInter(keys ...string) ([]string, int) {
+	return ds.combine(setInter, keys)
+}
+
+// SUnion returns the members found in any of the sets at keys
+func (ds *Datastore) SUnion(keys ...string) ([]string, int) {
+	return ds.combine(setUnion, keys)
+}
+
+// SDiff returns the members of the first set at keys that are in none of the
+// others
+func (ds *Datastore) SDiff(keys ...string) ([]string, int) {
+	return ds.combine(setDiff, keys)
+}
+
+func (ds *Datastore) combine(op string, keys []string) ([]string, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	result, expired, status := ds.combineLocked(op, keys)
+	if status != http.StatusOK {
+		return nil, status
+	}
+	return (&Data{set: result}).sortedMembers(), http.StatusOK
+}
+
+// SStore works out op, one of SINTER, SUNION or SDIFF, over the sets at keys
+// and stores the result at dst, replacing whatever was there, including its
+// TTL. An empty result deletes dst. It returns the size of the result.
+func (ds *Datastore) SStore(op, dst string, keys ...string) (int, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	result, expired, status := ds.combineLocked(op, keys)
+	for _, key := range expired {
+		ds.remove(key)
+	}
+	if status != http.StatusOK {
+		return 0, status
+	}
+	if len(result) == 0 {
+		ds.remove(dst)
+		return 0, http.StatusOK
+	}
+
+	data := &Data{isSet: true, set: result}
+	if !ds.makeRoom(dst, func() int { return data.approxSize(dst) }) {
+		return 0, http.StatusInsufficientStorage
+	}
+	ds.put(dst, data)
+
+	return len(result), http.StatusOK
+}
+
+// combineLocked works out op over the sets at keys, all read under the one
+// lock so the result is a consistent view, along with those of keys that have
+// expired. Missing and expired keys are empty sets. The caller must hold at
+// least the read lock, and remove the expired keys.
+func (ds *Datastore) combineLocked(op string, keys []string) (map[string]struct{}, []string, int) {
+	var expired []string
+	sets := make([]map[string]struct{}, len(keys))
+	for i, key := range keys {
+		data, ok := ds.data[key]
+		if !ok {
+			continue
+		}
+		if data.isExpired() {
+			expired = append(expired, key)
+			continue
+		}
+		if !data.isSet {
+			return nil, expired, http.StatusConflict
+		}
+		data.touch()
+		sets[i] = data.set
+	}
+
+	result := map[string]struct{}{}
+	switch op {
+	case setUnion:
+		for _, set := range sets {
+			for member := range set {
+				result[member] = struct{}{}
+			}
+		}
+	case setInter:
+	members:
+		for member := range sets[0] {
+			for _, set := range sets[1:] {
+				if _, ok := set[member]; !ok {
+					continue members
+				}
+			}
+			result[member] = struct{}{}
+		}
+	case setDiff:
+	remaining:
+		for member := range sets[0] {
+			for _, set := range sets[1:] {
+				if _, ok := set[member]; ok {
+					continue remaining
+				}
+			}
+			result[member] = struct{}{}
+		}
+	}
+
+	return result, expired, http.StatusOK
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// setAlgebraFixture is the data every set algebra case runs against
+var setAlgebraFixture = []step{
+	{"SADD a 1 2 3", `{"added":3}`, http.StatusOK},
+	{"SADD b 2 3 4", `{"added":3}`, http.StatusOK},
+	{"SADD c 5 6", `{"added":2}`, http.StatusOK},
+	{"SADD d 3", `{"added":1}`, http.StatusOK},
+	{"SET str v", `"Enter data sucessfull"`, http.StatusOK},
+}
+
+func TestSetAlgebra(t *testing.T) {
+	tests := []struct {
+		name string
+		step
+	}{
+		{"overlapping inter", step{"SINTER a b", `{"members":["2","3"]}`, http.StatusOK}},
+		{"overlapping union", step{"SUNION a b", `{"members":["1","2","3","4"]}`, http.StatusOK}},
+		{"overlapping diff", step{"SDIFF a b", `{"members":["1"]}`, http.StatusOK}},
+		{"disjoint inter", step{"SINTER a c", `{"members":[]}`, http.StatusOK}},
+		{"disjoint union", step{"SUNION a c", `{"members":["1","2","3","5","6"]}`, http.StatusOK}},
+		{"disjoint diff", step{"SDIFF a c", `{"members":["1","2","3"]}`, http.StatusOK}},
+		{"three way inter", step{"SINTER a b d", `{"members":["3"]}`, http.StatusOK}},
+		{"three way diff", step{"SDIFF b a c", `{"members":["4"]}`, http.StatusOK}},
+		{"single key", step{"SINTER a", `{"members":["1","2","3"]}`, http.StatusOK}},
+		{"inter with a missing key", step{"SINTER a missing", `{"members":[]}`, http.StatusOK}},
+		{"union with a missing key", step{"SUNION missing a", `{"members":["1","2","3"]}`, http.StatusOK}},
+		{"diff from a missing key", step{"SDIFF missing a", `{"members":[]}`, http.StatusOK}},
+		{"diff of a missing key", step{"SDIFF a missing", `{"members":["1","2","3"]}`, http.StatusOK}},
+		{"only missing keys", step{"SUNION missing other", `{"members":[]}`, http.StatusOK}},
+		{"wrong type", step{"SINTER a str", `"` + wrongTypeMessage + `"`, http.StatusConflict}},
+		{"no keys", step{"SINTER", `"Invalid Command"`, http.StatusBadRequest}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := NewDatastore(Options{})
+			runSteps(t, ds, setAlgebraFixture)
+			runSteps(t, ds, []step{tt.step})
+		})
+	}
+}
+
+// Set algebra only reads, so it must not wait for the write lock. Expired keys
+// are empty sets and are purged afterwards.
+func TestSetAlgebraTakesOnlyTheReadLock(t *testing.T) {
+	ds := NewDatastore(Options{})
+	runSteps(t, ds, setAlgebraFixture)
+
+	tests := []step{
+		{"SINTER a b", `{"members":["2","3"]}`, http.StatusOK},
+		{"SUNION a c", `{"members":["1","2","3","5","6"]}`, http.StatusOK},
+		{"SDIFF a b", `{"members":["1"]}`, http.StatusOK},
+		{"SINTER a str", `"` + wrongTypeMessage + `"`, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if got, status := underReadLock(t, ds, tt.command); got != tt.want || status != tt.status {
+			t.Errorf("%s = %s, %d, want %s, %d", tt.command, got, status, tt.want, tt.status)
+		}
+	}
+
+	expireNow(t, ds, "b")
+	runSteps(t, ds, []step{{"SDIFF a b", `{"members":["1","2","3"]}`, http.StatusOK}})
+	ds.mu.RLock()
+	_, ok := ds.data["b"]
+	ds.mu.RUnlock()
+	if ok {
+		t.Error("expired set b was not purged")
+	}
+}
+
+func TestSetAlgebraStore(t *testing.T) {
+	tests := []struct {
+		name  string
+		store step
+		dst   step // What is then read back from dst
+	}{
+		{
+			"overlapping",
+			step{"SINTERSTORE dst a b", `{"count":2}`, http.StatusOK},
+			step{"SMEMBERS dst", `{"members":["2","3"]}`, http.StatusOK},
+		},
+		{
+			"disjoint",
+			step{"SUNIONSTORE dst a c", `{"count":5}`, http.StatusOK},
+			step{"SMEMBERS dst", `{"members":["1","2","3","5","6"]}`, http.StatusOK},
+		},
+		{
+			"missing keys are empty sets",
+			step{"SDIFFSTORE dst a missing", `{"count":3}`, http.StatusOK},
+			step{"SMEMBERS dst", `{"members":["1","2","3"]}`, http.StatusOK},
+		},
+		{
+			"an empty result deletes dst",
+			step{"SINTERSTORE str a c", `{"count":0}`, http.StatusOK},
+			step{"EXISTS str", `{"count":0}`, http.StatusOK},
+		},
+		{
+			"dst replaces a value of another type",
+			step{"SUNIONSTORE str d", `{"count":1}`, http.StatusOK},
+			step{"TYPE str", `{"type":"set"}`, http.StatusOK},
+		},
+		{
+			"dst can be one of the sources",
+			step{"SDIFFSTORE a a b", `{"count":1}`, http.StatusOK},
+			step{"SMEMBERS a", `{"members":["1"]}`, http.StatusOK},
+		},
+		{
+			"wrong type leaves dst alone",
+			step{"SINTERSTORE d a str", `"` + wrongTypeMessage + `"`, http.StatusConflict},
+			step{"SMEMBERS d", `{"members":["3"]}`, http.StatusOK},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := NewDatastore(Options{})
+			runSteps(t, ds, setAlgebraFixture)
+			runSteps(t, ds, []step{tt.store, tt.dst})
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotEntry is the on-disk form of a single key
+type snapshotEntry struct {
+	Key      string            `json:"key"`
+	Value    string            `json:"value,omitempty"`
+	Expiry   *time.Time        `json:"expiry,omitempty"`
+	IsQueued bool              `json:"is_queued,omitempty"`
+	Queue    []string          `json:"queue,omitempty"`
+	Capacity int               `json:"capacity,omitempty"`
+	TrimCap  bool              `json:"trim_to_capacity,omitempty"`
+	IsHash   bool              `json:"is_hash,omitempty"`
+	Hash     map[string]string `json:"hash,omitempty"`
+	IsSet    bool              `json:"is_set,omitempty"`
+	Set      []string          `json:"set,omitempty"`
+	IsZSet   bool              `json:"is_zset,omitempty"`
+	ZSet     []ZMember         `json:"zset,omitempty"`
+	IsBitmap bool              `json:"is_bitmap,omitempty"`
+	Bitmap   []byte            `json:"bitmap,omitempty"`
+	IsHLL    bool              `json:"is_hll,omitempty"`
+	HLL      []byte            `json:"hll,omitempty"`
+	IsStream bool              `json:"is_stream,omitempty"`
+	Stream   []StreamEntry     `json:"stream,omitempty"`
+	StreamID string            `json:"stream_last_id,omitempty"`
+
+	// Deliveries holds the QRESERVE delivery count of each value in Queue,
+	// and is left out when none has been delivered
+	Deliveries []int `json:"deliveries,omitempty"`
+
+	DeadLetterKey string `json:"dlq,omitempty"`
+	MaxDeliveries int    `json:"max_deliver,omitempty"`
+	DeadLettered  int    `json:"dead_lettered,omitempty"`
+
+	// ReadyAt holds when each value in Queue pushed with a DELAY becomes
+	// visible, and is left out when none was
+	ReadyAt []time.Time `json:"ready_at,omitempty"`
+}
+
+// SaveSnapshot writes every non-expired key, with its absolute expiry, to
+// path. The file is written to a temporary name first and renamed into place
+// so a crash mid-write never leaves a truncated snapshot behind.
+func (ds *Datastore) SaveSnapshot(path string) error {
+	ds.mu.RLock()
+	entries := make([]snapshotEntry, 0, len(ds.data))
+	for key, data := range ds.data {
+		if data.isExpired() {
+			continue
+		}
+		items := append(data.reservedItems(), data.queue...) // Unacknowledged values are delivered again
+		entry := snapshotEntry{
+			Key:           key,
+			Value:         data.value,
+			IsQueued:      data.isQueued,
+			Queue:         itemValues(items),
+			Capacity:      data.capacity,
+			TrimCap:       data.trimToCap,
+			IsHash:        data.isHash,
+			Hash:          data.clone().hash, // Encoded after the lock is released
+			IsSet:         data.isSet,
+			IsZSet:        data.isZSet,
+			IsBitmap:      data.isBitmap,
+			Bitmap:        append([]byte(nil), data.bits...),
+			IsHLL:         data.isHLL,
+			IsStream:      data.isStream,
+			DeadLetterKey: data.deadLetterKey,
+			MaxDeliveries: data.maxDeliveries,
+			DeadLettered:  data.deadLettered,
+		}
+		if data.isSet {
+			entry.Set = data.sortedMembers()
+		}
+		if data.isZSet {
+			entry.ZSet = append([]ZMember(nil), data.zset.ordered...)
+		}
+		if data.isHLL {
+			entry.HLL = append([]byte(nil), data.hll[:]...)
+		}
+		if data.isStream {
+			entry.Stream = data.stream.after(streamID{}, 0)
+			entry.StreamID = data.stream.lastID.String()
+		}
+		for i, item := range items {
+			if item.deliveries > 0 {
+				if entry.Deliveries == nil {
+					entry.Deliveries = make([]int, len(items))
+				}
+				entry.Deliveries[i] = item.deliveries
+			}
+			if !item.readyAt.IsZero() {
+				if entry.ReadyAt == nil {
+					entry.ReadyAt = make([]time.Time, len(items))
+				}
+				entry.ReadyAt[i] = item.readyAt
+			}
+		}
+		if !data.expiry.IsZero() {
+			expiry := data.expiry
+			entry.Expiry = &expiry
+		}
+		entries = append(entries, entry)
+	}
+	ds.mu.RUnlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := json.NewEncoder(tmp).Encode(entries); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadSnapshot restores keys saved by SaveSnapshot, skipping keys whose expiry
+// has already passed. A missing file is not an error so the first start with a
+// fresh snapshot path succeeds.
+func (ds *Datastore) LoadSnapshot(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var entries []snapshotEntry
+	if err := json.NewDecoder(f).Decode(&entries); err != nil {
+		return err
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	now := time.Now()
+	for _, entry := range entries {
+		data := &Data{
+			value:         entry.Value,
+			isQueued:      entry.IsQueued,
+			queue:         newQueueItems(entry.Queue),
+			capacity:      entry.Capacity,
+			trimToCap:     entry.TrimCap,
+			isHash:        entry.IsHash,
+			hash:          entry.Hash,
+			isSet:         entry.IsSet,
+			isZSet:        entry.IsZSet,
+			isBitmap:      entry.IsBitmap,
+			bits:          entry.Bitmap,
+			isHLL:         entry.IsHLL,
+			isStream:      entry.IsStream,
+			deadLetterKey: entry.DeadLetterKey,
+			maxDeliveries: entry.MaxDeliveries,
+			deadLettered:  entry.DeadLettered,
+		}
+		for i, deliveries := range entry.Deliveries {
+			if i < len(data.queue) {
+				data.queue[i].deliveries = deliveries
+			}
+		}
+		for i, readyAt := range entry.ReadyAt {
+			if i < len(data.queue) {
+				data.queue[i].readyAt = readyAt
+				ds.scheduleReady(readyAt)
+			}
+		}
+		if entry.Expiry != nil {
+			if !now.Before(*entry.Expiry) {
+				continue
+			}
+			data.expiry = *entry.Expiry
+		}
+		if !data.isQueued {
+			data.queue = nil
+		}
+		if data.isHash && data.hash == nil {
+			data.hash = map[string]string{}
+		}
+		if data.isSet {
+			data.set = make(map[string]struct{}, len(entry.Set))
+			for _, member := range entry.Set {
+				data.set[member] = struct{}{}
+			}
+		}
+		if data.isZSet {
+			data.zset = newSortedSet()
+			for _, m := range entry.ZSet {
+				data.zset.add(m.Member, m.Score)
+			}
+		}
+		if data.isHLL {
+			data.hll = &hyperLogLog{}
+			copy(data.hll[:], entry.HLL)
+		}
+		if data.isStream {
+			data.stream = &stream{}
+			data.stream.lastID, _ = parseStreamID(entry.StreamID)
+			for _, e := range entry.Stream {
+				id, _ := parseStreamID(e.ID)
+				data.stream.entries = append(data.stream.entries, streamEntry{id, e.Value})
+			}
+		}
+		ds.put(entry.Key, data)
+	}
+
+	return nil
+}
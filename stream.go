@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamID identifies a stream entry: the Unix millisecond it was added, and
+// a sequence number telling apart entries added in the same millisecond
+type streamID struct {
+	ms, seq int64
+}
+
+func (id streamID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id streamID) less(other streamID) bool {
+	return id.ms < other.ms || (id.ms == other.ms && id.seq < other.seq)
+}
+
+// parseStreamID parses "<ms>-<seq>", or a bare "<ms>" meaning sequence 0
+func parseStreamID(s string) (streamID, bool) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseInt(msPart, 10, 64)
+	if err != nil || ms < 0 {
+		return streamID{}, false
+	}
+	var seq int64
+	if hasSeq {
+		if seq, err = strconv.ParseInt(seqPart, 10, 64); err != nil || seq < 0 {
+			return streamID{}, false
+		}
+	}
+	return streamID{ms, seq}, true
+}
+
+// StreamEntry is a stream entry as returned by XREAD
+type StreamEntry struct {
+	ID    string `json:"id"`
+	Value string `json:"value"`
+}
+
+type streamEntry struct {
+	id    streamID
+	value string
+}
+
+// stream is an append-only log. lastID outlives trimmed entries so IDs keep
+// increasing even once the stream has been emptied.
+type stream struct {
+	entries []streamEntry
+	lastID  streamID
+}
+
+// nextID returns the ID for an entry added at now. A clock that has gone
+// backwards keeps the last millisecond and bumps the sequence instead.
+func (s *stream) nextID(now time.Time) streamID {
+	ms := now.UnixNano() / int64(time.Millisecond)
+	if ms > s.lastID.ms {
+		return streamID{ms, 0}
+	}
+	return streamID{s.lastID.ms, s.lastID.seq + 1}
+}
+
+// after returns up to count entries with IDs greater than id, oldest first.
+// A count of 0 means no limit.
+func (s *stream) after(id streamID, count int) []StreamEntry {
+	entries := []StreamEntry{}
+	for _, e := range s.entries {
+		if !id.less(e.id) {
+			continue
+		}
+		if count > 0 && len(entries) == count {
+			break
+		}
+		entries = append(entries, StreamEntry{ID: e.id.String(), Value: e.value})
+	}
+	return entries
+}
+
+// trim drops the oldest entries beyond maxLen
+func (s *stream) trim(maxLen int) {
+	if excess := len(s.entries) - maxLen; excess > 0 {
+		s.entries = append([]streamEntry(nil), s.entries[excess:]...)
+	}
+}
+
+func (s *stream) clone() *stream {
+	return &stream{entries: append([]streamEntry(nil), s.entries...), lastID: s.lastID}
+}
+
+// XAdd appends value to the stream at key, creating it if missing, and
+// returns the new entry's ID. A maxLen of 0 or more then trims the stream to
+// that many of its newest entries, while -1 leaves it to grow. The stream
+// keeps any TTL it already has. Blocked XREAD callers are woken.
+func (ds *Datastore) XAdd(key, value string, maxLen int) (string, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if !ok {
+		data = &Data{isStream: true, stream: &stream{}}
+	} else if !data.isStream {
+		return wrongTypeMessage, http.StatusConflict
+	}
+
+	if !ds.makeRoom(key, func() int { return data.approxSize(key) + streamEntryOverheadBytes + len(value) }) {
+		return outOfMemoryMessage, http.StatusInsufficientStorage
+	}
+	if !ok {
+		ds.put(key, data)
+	}
+
+	id := data.stream.nextID(time.Now())
+	data.stream.entries = append(data.stream.entries, streamEntry{id, value})
+	data.stream.lastID = id
+	if maxLen >= 0 {
+		data.stream.trim(maxLen)
+	}
+	ds.wakeStreamReaders(key)
+
+	return id.String(), http.StatusOK
+}
+
+// XLen returns the number of entries in the stream at key, 0 if the key is
+// missing
+func (ds *Datastore) XLen(key string) (int, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return 0, http.StatusOK
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return 0, http.StatusOK
+	}
+	if !data.isStream {
+		return 0, http.StatusConflict
+	}
+
+	return len(data.stream.entries), http.StatusOK
+}
+
+// XRead returns up to count entries of the stream at key with IDs after the
+// cursor, oldest first, or all of them when count is 0. The cursor is an
+// entry ID, or "$" for the stream's last ID. Reading never removes entries,
+// so any number of consumers can follow the same stream, each with its own
+// cursor. A missing key gives no entries.
+//
+// When block is set and there are no such entries, XRead waits up to
+// timeoutSeconds, with the same rules as BQPop, for XADD to add one.
+func (ds *Datastore) XRead(ctx context.Context, key, cursor string, count int, block bool, timeoutSeconds float64) ([]StreamEntry, int) {
+	if !block {
+		return ds.xReadNow(key, cursor, count)
+	}
+
+	expired, stop := ds.blockTimer(timeoutSeconds)
+	defer stop()
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	var after streamID
+	if cursor == "$" {
+		if data, ok := ds.lookup(key); ok && data.isStream {
+			after = data.stream.lastID
+		}
+	} else {
+		var ok bool
+		if after, ok = parseStreamID(cursor); !ok {
+			return nil, http.StatusBadRequest
+		}
+	}
+
+	for {
+		entries := []StreamEntry{}
+		if data, ok := ds.lookup(key); ok {
+			if !data.isStream {
+				return nil, http.StatusConflict
+			}
+			data.touch()
+			entries = data.stream.after(after, count)
+		}
+		if len(entries) > 0 {
+			return entries, http.StatusOK
+		}
+
+		wake := make(chan struct{}, 1)
+		ds.streamReaders[key] = append(ds.streamReaders[key], wake)
+		status := ds.block(ctx, wake, expired)
+		ds.removeStreamReader(key, wake)
+		if status != http.StatusOK {
+			return nil, status
+		}
+	}
+}
+
+// xReadNow is XRead without blocking, which only needs the read lock
+func (ds *Datastore) xReadNow(key, cursor string, count int) ([]StreamEntry, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if ok && data.isExpired() {
+		expired = append(expired, key)
+		ok = false
+	}
+
+	var after streamID
+	if cursor == "$" {
+		if ok && data.isStream {
+			after = data.stream.lastID
+		}
+	} else {
+		var valid bool
+		if after, valid = parseStreamID(cursor); !valid {
+			return nil, http.StatusBadRequest
+		}
+	}
+
+	if !ok {
+		return []StreamEntry{}, http.StatusOK
+	}
+	if !data.isStream {
+		return nil, http.StatusConflict
+	}
+	data.touch()
+	return data.stream.after(after, count), http.StatusOK
+}
+
+// wakeStreamReaders signals every XREAD caller blocked on key, each of which
+// then reads the stream again. The caller must hold the write lock.
+func (ds *Datastore) wakeStreamReaders(key string) {
+	for _, wake := range ds.streamReaders[key] {
+		wake <- struct{}{}
+	}
+	delete(ds.streamReaders, key)
+}
+
+// removeStreamReader takes wake off key's list of blocked XREAD callers if it
+// is still there. The caller must hold the write lock.
+func (ds *Datastore) removeStreamReader(key string, wake chan struct{}) {
+	readers := ds.streamReaders[key]
+	for i, other := range readers {
+		if other == wake {
+			readers = append(readers[:i], readers[i+1:]...)
+			break
+		}
+	}
+	if len(readers) == 0 {
+		delete(ds.streamReaders, key)
+	} else {
+		ds.streamReaders[key] = readers
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ZMember is a sorted set member with its score
+type ZMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// sortedSet keeps its members both by name, for score lookups, and in a
+// slice ordered by score with ties broken by member, for range queries.
+// Updates binary search the slice, which is plenty at leaderboard sizes.
+type sortedSet struct {
+	scores  map[string]float64
+	ordered []ZMember
+}
+
+func newSortedSet() *sortedSet {
+	return &sortedSet{scores: map[string]float64{}}
+}
+
+// zless reports whether a sorts before b
+func zless(a, b ZMember) bool {
+	if a.Score != b.Score {
+		return a.Score < b.Score
+	}
+	return a.Member < b.Member
+}
+
+// search returns the index at which m is, or would be, in the ordered slice
+func (z *sortedSet) search(m ZMember) int {
+	return sort.Search(len(z.ordered), func(i int) bool { return !zless(z.ordered[i], m) })
+}
+
+// add sets member's score and reports whether member is new. A changed score
+// moves the member to its new place in the order.
+func (z *sortedSet) add(member string, score float64) bool {
+	old, exists := z.scores[member]
+	if exists {
+		if old == score {
+			return false
+		}
+		z.remove(member)
+	}
+
+	m := ZMember{member, score}
+	i := z.search(m)
+	z.ordered = append(z.ordered, ZMember{})
+	copy(z.ordered[i+1:], z.ordered[i:])
+	z.ordered[i] = m
+	z.scores[member] = score
+
+	return !exists
+}
+
+// remove deletes member and reports whether it was there
+func (z *sortedSet) remove(member string) bool {
+	score, exists := z.scores[member]
+	if !exists {
+		return false
+	}
+
+	i := z.search(ZMember{member, score})
+	z.ordered = append(z.ordered[:i], z.ordered[i+1:]...)
+	delete(z.scores, member)
+
+	return true
+}
+
+func (z *sortedSet) clone() *sortedSet {
+	c := &sortedSet{
+		scores:  make(map[string]float64, len(z.scores)),
+		ordered: append([]ZMember(nil), z.ordered...),
+	}
+	for member, score := range z.scores {
+		c.scores[member] = score
+	}
+	return c
+}
+
+// ZAdd sets the scores of members in the sorted set at key, creating it if
+// missing, and returns how many members are new. Members already present
+// move to their new score.
+func (ds *Datastore) ZAdd(key string, members ...ZMember) (int, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if !ok {
+		data = &Data{isZSet: true, zset: newSortedSet()}
+	} else if !data.isZSet {
+		return 0, http.StatusConflict
+	}
+
+	size := func() int {
+		size := data.approxSize(key)
+		for _, m := range members {
+			size += zsetMemberOverheadBytes + len(m.Member)
+		}
+		return size
+	}
+	if !ds.makeRoom(key, size) {
+		return 0, http.StatusInsufficientStorage
+	}
+	if !ok {
+		ds.put(key, data)
+	}
+
+	added := 0
+	for _, m := range members {
+		if data.zset.add(m.Member, m.Score) {
+			added++
+		}
+	}
+	ds.serveWaiters(key)
+
+	return added, http.StatusOK
+}
+
+// ZScore returns the score of member in the sorted set at key. A missing key
+// or member gives StatusNotFound.
+func (ds *Datastore) ZScore(key, member string) (float64, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return 0, http.StatusNotFound
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return 0, http.StatusNotFound
+	}
+	if !data.isZSet {
+		return 0, http.StatusConflict
+	}
+	score, ok := data.zset.scores[member]
+	if !ok {
+		return 0, http.StatusNotFound
+	}
+	data.touch()
+
+	return score, http.StatusOK
+}
+
+// ZCard returns the number of members in the sorted set at key, 0 if the key
+// is missing
+func (ds *Datastore) ZCard(key string) (int, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return 0, http.StatusOK
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return 0, http.StatusOK
+	}
+	if !data.isZSet {
+		return 0, http.StatusConflict
+	}
+
+	return len(data.zset.ordered), http.StatusOK
+}
+
+// ZRange returns the members between ranks start and stop inclusive, lowest
+// score first, with the same index rules as QRange. A missing key gives an
+// empty result.
+func (ds *Datastore) ZRange(key string, start, stop int) ([]ZMember, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return []ZMember{}, http.StatusOK
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return []ZMember{}, http.StatusOK
+	}
+	if !data.isZSet {
+		return nil, http.StatusConflict
+	}
+	data.touch()
+
+	start, stop, ok = clampRange(start, stop, len(data.zset.ordered))
+	if !ok {
+		return []ZMember{}, http.StatusOK
+	}
+
+	return append([]ZMember{}, data.zset.ordered[start:stop+1]...), http.StatusOK
+}
+
+// ZRangeByScore returns the members with scores between min and max, lowest
+// first. Each bound is inclusive unless its exclusive flag is set. A missing
+// key gives an empty result.
+func (ds *Datastore) ZRangeByScore(key string, min float64, minExclusive bool, max float64, maxExclusive bool) ([]ZMember, int) {
+	var expired []string
+	defer func() { ds.purgeExpired(expired...) }() // Runs after the read lock is released
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	data, ok := ds.data[key]
+	if !ok {
+		return []ZMember{}, http.StatusOK
+	}
+	if data.isExpired() {
+		expired = append(expired, key)
+		return []ZMember{}, http.StatusOK
+	}
+	if !data.isZSet {
+		return nil, http.StatusConflict
+	}
+	data.touch()
+
+	ordered := data.zset.ordered
+	from := sort.Search(len(ordered), func(i int) bool {
+		return ordered[i].Score > min || (!minExclusive && ordered[i].Score == min)
+	})
+	to := sort.Search(len(ordered), func(i int) bool {
+		return ordered[i].Score > max || (maxExclusive && ordered[i].Score == max)
+	})
+	if from >= to {
+		return []ZMember{}, http.StatusOK
+	}
+
+	return append([]ZMember{}, ordered[from:to]...), http.StatusOK
+}
+
+// zmemberNames returns just the member names of members
+func zmemberNames(members []ZMember) []string {
+	names := make([]string, len(members))
+	for i, m := range members {
+		names[i] = m.Member
+	}
+	return names
+}
+
+// parseScore parses a ZADD score. Infinite scores are refused as well as NaN
+// since snapshots are JSON, which has no way to write them.
+func parseScore(s string) (float64, bool) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(score) || math.IsInf(score, 0) {
+		return 0, false
+	}
+	return score, true
+}
+
+// parseScoreBound parses a ZRANGEBYSCORE bound. A leading "(" makes it
+// exclusive, and -inf and +inf leave that end open.
+func parseScoreBound(s string) (float64, bool, bool) {
+	exclusive := strings.HasPrefix(s, "(")
+	bound, err := strconv.ParseFloat(strings.TrimPrefix(s, "("), 64)
+	if err != nil || math.IsNaN(bound) {
+		return 0, false, false
+	}
+	return bound, exclusive, true
+}
+
+// pop removes and returns the member with the lowest score, or the highest
+// when max is set. The set must not be empty.
+func (z *sortedSet) pop(max bool) ZMember {
+	var m ZMember
+	if max {
+		m = z.ordered[len(z.ordered)-1]
+		z.ordered = z.ordered[:len(z.ordered)-1]
+	} else {
+		m = z.ordered[0]
+		z.ordered = z.ordered[1:]
+	}
+	delete(z.scores, m.Member)
+	return m
+}
+
+// ZPopMin removes and returns up to count members with the lowest scores,
+// lowest first. A missing key gives an empty result.
+func (ds *Datastore) ZPopMin(key string, count int) ([]ZMember, int) {
+	return ds.zpop(key, count, false)
+}
+
+// ZPopMax removes and returns up to count members with the highest scores,
+// highest first. A missing key gives an empty result.
+func (ds *Datastore) ZPopMax(key string, count int) ([]ZMember, int) {
+	return ds.zpop(key, count, true)
+}
+
+func (ds *Datastore) zpop(key string, count int, max bool) ([]ZMember, int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, ok := ds.lookup(key)
+	if !ok {
+		return []ZMember{}, http.StatusOK
+	}
+	if !data.isZSet {
+		return nil, http.StatusConflict
+	}
+
+	members := []ZMember{}
+	for len(members) < count && len(data.zset.ordered) > 0 {
+		members = append(members, ds.zpopLocked(key, data, max))
+	}
+	return members, http.StatusOK
+}
+
+// zpopLocked pops one member from data, the non-empty sorted set at key, and
+// deletes the key once it is empty. The caller must hold the write lock.
+func (ds *Datastore) zpopLocked(key string, data *Data, max bool) ZMember {
+	m := data.zset.pop(max)
+	if len(data.zset.ordered) == 0 {
+		ds.remove(key)
+	}
+	return m
+}
+
+// BZPop pops the lowest scoring member, or the highest when max is set, from
+// the first of keys holding a sorted set, waiting up to timeoutSeconds for
+// one to be added. It returns the key the member came from. Waiting shares
+// BQPop's FIFO waiter lists and timeout rules, so ZADD hands members
+// straight to the longest waiting caller.
+func (ds *Datastore) BZPop(ctx context.Context, keys []string, timeoutSeconds float64, max bool) (string, ZMember, int) {
+	expired, stop := ds.blockTimer(timeoutSeconds)
+	defer stop()
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	// Empty sorted sets are deleted, so any set found has a member to pop
+	for _, key := range keys {
+		data, ok := ds.lookup(key)
+		if !ok || !data.isZSet {
+			continue
+		}
+		return key, ds.zpopLocked(key, data, max), http.StatusOK
+	}
+
+	w := &queueWaiter{keys: keys, zpop: true, back: max, wake: make(chan struct{}, 1)}
+	ds.addWaiter(w)
+
+	status := ds.block(ctx, w.wake, expired)
+
+	if w.served {
+		return w.key, ZMember{Member: w.value, Score: w.score}, w.status
+	}
+	ds.removeWaiter(w)
+
+	return "", ZMember{}, status
+}
+
+// serveZPopWaiters hands members of data, the sorted set at key, to the
+// BZPOPMIN and BZPOPMAX callers blocked on it. The caller must hold the write
+// lock.
+func (ds *Datastore) serveZPopWaiters(key string, data *Data) {
+	for len(data.zset.ordered) > 0 {
+		w := ds.nextWaiter(key, true)
+		if w == nil {
+			return
+		}
+		ds.removeWaiter(w)
+
+		m := ds.zpopLocked(key, data, w.back)
+		w.value, w.score, w.status = m.Member, m.Score, http.StatusOK
+		w.key, w.served = key, true
+		w.wake <- struct{}{}
+	}
+}
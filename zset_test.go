@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"testing"
+)
+
+func TestSortedSetCommands(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"ties are ordered by member", []step{
+			{"ZADD z 1 c 1 a 1 b 0 d", `{"added":4}`, http.StatusOK},
+			{"ZRANGE z 0 -1", `{"members":["d","a","b","c"]}`, http.StatusOK},
+		}},
+		{"raising a score moves the member up", []step{
+			{"ZADD z 1 a 2 b 3 c", `{"added":3}`, http.StatusOK},
+			{"ZADD z 5 a", `{"added":0}`, http.StatusOK},
+			{"ZRANGE z 0 -1", `{"members":["b","c","a"]}`, http.StatusOK},
+			{"ZSCORE z a", `{"score":5}`, http.StatusOK},
+			{"ZCARD z", `{"count":3}`, http.StatusOK},
+		}},
+		{"lowering a score moves the member down", []step{
+			{"ZADD z 1 a 2 b 3 c", `{"added":3}`, http.StatusOK},
+			{"ZADD z -1 c", `{"added":0}`, http.StatusOK},
+			{"ZRANGE z 0 -1 WITHSCORES", `{"members":[{"member":"c","score":-1},{"member":"a","score":1},{"member":"b","score":2}]}`, http.StatusOK},
+		}},
+		{"an update into a tie sorts by member", []step{
+			{"ZADD z 1 b 2 a 3 c", `{"added":3}`, http.StatusOK},
+			{"ZADD z 3 a 1 c", `{"added":0}`, http.StatusOK},
+			{"ZRANGE z 0 -1", `{"members":["b","c","a"]}`, http.StatusOK},
+			{"ZADD z 1 a", `{"added":0}`, http.StatusOK},
+			{"ZRANGE z 0 -1", `{"members":["a","b","c"]}`, http.StatusOK},
+		}},
+		{"the same member twice in one ZADD keeps the last score", []step{
+			{"ZADD z 1 a 2 a", `{"added":1}`, http.StatusOK},
+			{"ZRANGE z 0 -1 WITHSCORES", `{"members":[{"member":"a","score":2}]}`, http.StatusOK},
+			{"ZCARD z", `{"count":1}`, http.StatusOK},
+		}},
+		{"ranks", []step{
+			{"ZADD z 1 a 2 b 3 c 4 d", `{"added":4}`, http.StatusOK},
+			{"ZRANGE z 1 2", `{"members":["b","c"]}`, http.StatusOK},
+			{"ZRANGE z -2 -1", `{"members":["c","d"]}`, http.StatusOK},
+			{"ZRANGE z 2 100", `{"members":["c","d"]}`, http.StatusOK},
+			{"ZRANGE z 3 1", `{"members":[]}`, http.StatusOK},
+			{"ZRANGE z 10 20", `{"members":[]}`, http.StatusOK},
+		}},
+		{"score ranges", []step{
+			{"ZADD z 1 a 2 b 2 bb 3 c 4.5 d", `{"added":5}`, http.StatusOK},
+			{"ZRANGEBYSCORE z 2 3", `{"members":["b","bb","c"]}`, http.StatusOK},
+			{"ZRANGEBYSCORE z (2 3", `{"members":["c"]}`, http.StatusOK},
+			{"ZRANGEBYSCORE z 2 (3", `{"members":["b","bb"]}`, http.StatusOK},
+			{"ZRANGEBYSCORE z -inf 1", `{"members":["a"]}`, http.StatusOK},
+			{"ZRANGEBYSCORE z 4 +inf WITHSCORES", `{"members":[{"member":"d","score":4.5}]}`, http.StatusOK},
+			{"ZRANGEBYSCORE z 3 2", `{"members":[]}`, http.StatusOK},
+			{"ZRANGEBYSCORE z x 2", `"min or max is not a valid number"`, http.StatusBadRequest},
+		}},
+		{"a missing key", []step{
+			{"ZSCORE z a", `"Member not exist"`, http.StatusNotFound},
+			{"ZCARD z", `{"count":0}`, http.StatusOK},
+			{"ZRANGE z 0 -1", `{"members":[]}`, http.StatusOK},
+			{"ZRANGEBYSCORE z -inf +inf", `{"members":[]}`, http.StatusOK},
+		}},
+		{"a missing member", []step{
+			{"ZADD z 1 a", `{"added":1}`, http.StatusOK},
+			{"ZSCORE z b", `"Member not exist"`, http.StatusNotFound},
+		}},
+		{"scores must be finite numbers", []step{
+			{"ZADD z nan a", `"score is not a valid finite number"`, http.StatusBadRequest},
+			{"ZADD z inf a", `"score is not a valid finite number"`, http.StatusBadRequest},
+			{"ZADD z 1 a x b", `"score is not a valid finite number"`, http.StatusBadRequest},
+			{"EXISTS z", `{"count":0}`, http.StatusOK},
+		}},
+		{"another type", []step{
+			{"SET z v", `"Enter data sucessfull"`, http.StatusOK},
+			{"ZADD z 1 a", `"` + wrongTypeMessage + `"`, http.StatusConflict},
+			{"ZSCORE z a", `"` + wrongTypeMessage + `"`, http.StatusConflict},
+			{"ZCARD z", `"` + wrongTypeMessage + `"`, http.StatusConflict},
+			{"ZRANGE z 0 -1", `"` + wrongTypeMessage + `"`, http.StatusConflict},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runSteps(t, NewDatastore(Options{}), tt.steps)
+		})
+	}
+}
+
+// TestSortedSetStaysOrderedUnderUpdates applies many random score changes
+// and removals and checks the ordered slice against sorting the scores map
+func TestSortedSetStaysOrderedUnderUpdates(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	z := newSortedSet()
+	for i := 0; i < 5000; i++ {
+		member := fmt.Sprintf("m%d", rng.Intn(200))
+		if rng.Intn(5) == 0 {
+			z.remove(member)
+		} else {
+			z.add(member, float64(rng.Intn(20))) // Few scores, so plenty of ties
+		}
+	}
+
+	want := make([]ZMember, 0, len(z.scores))
+	for member, score := range z.scores {
+		want = append(want, ZMember{member, score})
+	}
+	sort.Slice(want, func(i, j int) bool { return zless(want[i], want[j]) })
+
+	if len(z.ordered) != len(want) {
+		t.Fatalf("ordered has %d members, scores has %d", len(z.ordered), len(want))
+	}
+	for i := range want {
+		if z.ordered[i] != want[i] {
+			t.Fatalf("ordered[%d] = %v, want %v", i, z.ordered[i], want[i])
+		}
+	}
+}